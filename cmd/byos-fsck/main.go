@@ -0,0 +1,70 @@
+// Command byos-fsck checks a queue store for inconsistencies without modifying it.
+// The store must not be in use while it is checked.
+// The command has no access to the keys of encrypted stores. Hence only the checksums of their encrypted dicts
+// are verified. The logs with encrypted dicts are reported as unchecked.
+//
+// Usage:
+//
+//	byos-fsck [-v] <directory>
+//
+// The exit code follows the conventions of fsck:
+//
+//	0   No problems have been found
+//	1   All problems are repaired when the store is opened, e.g. a torn action at the end of the commit log
+//	4   Problems have been found which are not repaired when the store is opened
+//	8   The store could not be checked
+//	16  Usage error
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/weistn/byos/queue"
+)
+
+const (
+	exitOK          = 0
+	exitRecoverable = 1
+	exitProblems    = 4
+	exitFailed      = 8
+	exitUsage       = 16
+)
+
+func main() {
+	verbose := flag.Bool("v", false, "print a summary even if no problems have been found")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-v] <directory>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	report, err := queue.Check(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFailed)
+	}
+	for _, p := range report.Problems {
+		if p.Recoverable {
+			fmt.Println(p.String(), "(repaired on open)")
+		} else {
+			fmt.Println(p.String())
+		}
+	}
+	if *verbose || len(report.Problems) > 0 {
+		fmt.Printf("%v finalized logs, %v streams, %v problems\n", report.Logs, report.Streams, len(report.Problems))
+	}
+	if report.Unchecked > 0 {
+		fmt.Printf("%v finalized logs have encrypted dicts whose content has not been checked\n", report.Unchecked)
+	}
+	if len(report.Problems) == 0 {
+		os.Exit(exitOK)
+	} else if report.Recoverable() {
+		os.Exit(exitRecoverable)
+	}
+	os.Exit(exitProblems)
+}
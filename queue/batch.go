@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"sort"
+)
+
+// An Append is a single append of a batch passed to AppendBatch.
+type Append struct {
+	StreamName string
+	Data       []byte
+	// Marks the end of a record like AppendRecord.
+	Record bool
+}
+
+// AppendBatch writes data to several streams atomically. After a crash either all appends
+// of the batch are recovered or none of them. The appends of the same stream are applied in order.
+// AppendBatch returns once the batch and all data written before has been synced to disk,
+// which requires a single sync for the whole batch. Batches of more than 1GB in total are rejected.
+func (f *Frontend) AppendBatch(appends []Append) error {
+	if len(appends) == 0 {
+		return nil
+	}
+	// The batch is written as a single action, which must not push the log beyond 4GB
+	var total int64
+	for _, a := range appends {
+		total += int64(len(a.Data))
+	}
+	if total > maxLogSize/2 {
+		return errAppendTooLarge
+	}
+	// Lock the streams in a fixed order to avoid deadlocks between batches
+	type state struct{ from, size, keep, records uint64 }
+	states := make(map[string]*state)
+	var names []string
+	for _, a := range appends {
+		if _, ok := states[a.StreamName]; !ok {
+			states[a.StreamName] = &state{}
+			names = append(names, a.StreamName)
+		}
+	}
+	sort.Strings(names)
+	locks := make([]*streamLock, len(names))
+	for i, name := range names {
+		locks[i] = f.lockStream(name)
+	}
+	unlock := func() {
+		for i, name := range names {
+			f.unlockStream(name, locks[i])
+		}
+	}
+
+	// Appends to the same stream follow each other
+	for _, name := range names {
+		size, keep, records, err := f.appendState(name)
+		if err != nil {
+			unlock()
+			return err
+		}
+		*states[name] = state{from: size, size: size, keep: keep, records: records}
+	}
+	b := &batchAction{appends: make([]appendAction, len(appends))}
+	for i, a := range appends {
+		s := states[a.StreamName]
+		var flags actionFlags = flagAppend
+		if a.Record {
+			flags |= endOfRecord
+		}
+		action, err := f.newAppendAction(a.StreamName, a.Data, flags, s.size, s.keep, s.records)
+		if err != nil {
+			unlock()
+			return err
+		}
+		b.appends[i] = *action
+		s.size += uint64(len(a.Data))
+		if a.Record {
+			s.records++
+		}
+	}
+
+	f.mutex.Lock()
+	seq, err := f.write(b, true)
+	if err == nil {
+		for _, name := range names {
+			f.appended(name, seq, states[name].from)
+		}
+	}
+	f.mutex.Unlock()
+	unlock()
+	if err != nil {
+		return err
+	}
+	return f.waitDurable(seq)
+}
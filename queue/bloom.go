@@ -0,0 +1,129 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"strings"
+)
+
+// Number of filter bits per stream name
+const bloomBitsPerName = 10
+
+// Number of hash functions, which is optimal for 10 bits per name
+const bloomHashes = 7
+
+var errFilter = errors.New("Malformed log filter")
+
+// The logFilter of a finalized log tells which streams are not stored in the log
+// without searching the dict.
+//
+// The filter is serialized as:
+//
+//	hashes    uint8
+//	min       string   terminated by 0
+//	max       string   terminated by 0
+//	length    uint32   number of bytes in bits
+//	bits      [length]byte
+type logFilter struct {
+	// The smallest and largest stream name stored in the log
+	min string
+	max string
+	// The bloom filter over all stream names
+	bits   []byte
+	hashes uint8
+}
+
+// newLogFilter returns a filter for the sorted stream names.
+func newLogFilter(names []string) *logFilter {
+	f := &logFilter{hashes: bloomHashes}
+	if len(names) == 0 {
+		return f
+	}
+	f.min = names[0]
+	f.max = names[len(names)-1]
+	f.bits = make([]byte, (len(names)*bloomBitsPerName+7)/8)
+	for _, n := range names {
+		f.add(n)
+	}
+	return f
+}
+
+// bloomHash returns two independent hashes of the stream name,
+// which are combined to compute the bit positions.
+func bloomHash(streamName string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(streamName))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (f *logFilter) add(streamName string) {
+	h1, h2 := bloomHash(streamName)
+	bits := uint32(len(f.bits) * 8)
+	for i := uint32(0); i < uint32(f.hashes); i++ {
+		bit := (h1 + i*h2) % bits
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// mayContain returns false if the stream is not stored in the log.
+func (f *logFilter) mayContain(streamName string) bool {
+	if len(f.bits) == 0 || streamName < f.min || streamName > f.max {
+		return false
+	}
+	h1, h2 := bloomHash(streamName)
+	bits := uint32(len(f.bits) * 8)
+	for i := uint32(0); i < uint32(f.hashes); i++ {
+		bit := (h1 + i*h2) % bits
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mayContainPrefix returns false if no stream starting with the prefix is stored in the log.
+func (f *logFilter) mayContainPrefix(prefix string) bool {
+	if len(f.bits) == 0 || f.max < prefix {
+		return false
+	}
+	return f.min <= prefix || strings.HasPrefix(f.min, prefix)
+}
+
+func (f *logFilter) marshal(buf *bytes.Buffer) {
+	buf.WriteByte(f.hashes)
+	buf.WriteString(f.min)
+	buf.WriteByte(0)
+	buf.WriteString(f.max)
+	buf.WriteByte(0)
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(f.bits)))
+	buf.Write(length[:])
+	buf.Write(f.bits)
+}
+
+func (f *logFilter) unmarshal(data []byte) error {
+	if len(data) < 1 {
+		return errFilter
+	}
+	f.hashes = data[0]
+	data = data[1:]
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return errFilter
+	}
+	f.min = string(data[:i])
+	data = data[i+1:]
+	if i = bytes.IndexByte(data, 0); i < 0 {
+		return errFilter
+	}
+	f.max = string(data[:i])
+	data = data[i+1:]
+	if len(data) < 4 || uint64(binary.LittleEndian.Uint32(data)) != uint64(len(data)-4) {
+		return errFilter
+	}
+	f.bits = append([]byte{}, data[4:]...)
+	return nil
+}
@@ -0,0 +1,337 @@
+package queue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// A Problem is an inconsistency found by Check.
+type Problem struct {
+	// The base name of the log file
+	File string
+	// The stream concerned, or an empty string if the problem concerns the log file as a whole
+	Stream  string
+	Message string
+	// True if opening the store with NewFrontend repairs the problem, e.g. by dropping a torn
+	// action from the end of the commit log. Other problems cause data loss or errors.
+	Recoverable bool
+}
+
+func (p Problem) String() string {
+	if p.Stream == "" {
+		return p.File + ": " + p.Message
+	}
+	return p.File + ": stream " + p.Stream + ": " + p.Message
+}
+
+// A CheckReport tells the result of Check.
+type CheckReport struct {
+	// The number of finalized log files checked
+	Logs int
+	// The number of distinct streams found
+	Streams int
+	// The number of finalized log files whose dict has not been checked, because it is encrypted and no keys have been supplied.
+	// Only the checksums of their actions and dicts have been verified.
+	Unchecked int
+	// The problems in the order of the log files
+	Problems []Problem
+}
+
+// Recoverable returns true if all problems are repaired by opening the store with NewFrontend.
+func (r *CheckReport) Recoverable() bool {
+	for _, p := range r.Problems {
+		if !p.Recoverable {
+			return false
+		}
+	}
+	return true
+}
+
+// checkedStream is the state of a stream known from the logs checked so far.
+type checkedStream struct {
+	// The size of the stream
+	size uint64
+	// The number of records ended in the stream
+	records uint64
+	deleted bool
+}
+
+// Check validates the store in the directory pathName without modifying it.
+// The store must not be in use.
+// It checks the trailer, dict and filter of every finalized log file, verifies the checksums of all actions,
+// checks that the dict pieces point into the file and cross-checks the continuity of the streams between logs.
+// The commit log is replayed as recovery would do it.
+// Check returns an error only if the store cannot be checked at all.
+// Only the checksums of the encrypted dicts of an encrypted store are verified, see CheckReport.Unchecked.
+// Use CheckWithKeys to check their content as well.
+func Check(pathName string) (*CheckReport, error) {
+	return CheckWithKeys(pathName, nil)
+}
+
+// CheckWithKeys is like Check, but decrypts the dicts of the store with the keys.
+func CheckWithKeys(pathName string, keys KeyProvider) (*CheckReport, error) {
+	return CheckStorage(DiskStorage, pathName, keys)
+}
+
+// CheckStorage is like CheckWithKeys, but checks a store held by the storage.
+func CheckStorage(storage Storage, pathName string, keys KeyProvider) (*CheckReport, error) {
+	names, err := storage.ReadDir(pathName)
+	if err != nil {
+		return nil, err
+	}
+	report := &CheckReport{}
+	var files []string
+	for _, n := range names {
+		if isLogFileName(n) {
+			files = append(files, filepath.Join(pathName, n))
+		} else if isCompactionFileName(n) {
+			report.Problems = append(report.Problems, Problem{File: n, Message: "Left over by an incomplete compaction", Recoverable: true})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return logFileNumber(files[i]) < logFileNumber(files[j])
+	})
+	// Log files merged by a compaction which did not complete are removed when the store is opened
+	merged, err := mergedLogs(storage, files)
+	if err != nil {
+		return nil, err
+	}
+	var remaining []string
+	for _, n := range files {
+		if merged[n] {
+			report.Problems = append(report.Problems, Problem{File: filepath.Base(n), Message: "Left over by an incomplete compaction", Recoverable: true})
+		} else {
+			remaining = append(remaining, n)
+		}
+	}
+	files = remaining
+	streams := make(map[string]*checkedStream)
+	for i, n := range files {
+		if i == len(files)-1 {
+			// The latest log is recovered, unless it has been finalized
+			finalized, err := checkCommitLog(storage, n, keys, streams, report)
+			if err != nil {
+				return nil, err
+			} else if !finalized {
+				break
+			}
+		}
+		if err := checkFinalizedLog(storage, n, keys, streams, report); err != nil {
+			return nil, err
+		}
+		report.Logs++
+	}
+	report.Streams = len(streams)
+	return report, nil
+}
+
+// checkCommitLog replays the commit log and cross-checks its streams.
+// It returns true if the log is finalized, which must be checked by checkFinalizedLog then.
+func checkCommitLog(storage Storage, fileName string, keys KeyProvider, streams map[string]*checkedStream, report *CheckReport) (finalized bool, err error) {
+	file := filepath.Base(fileName)
+	info, err := storage.Stat(fileName)
+	if err != nil {
+		return false, err
+	}
+	f, err := storage.Open(fileName)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	c := newCommitLog(storage)
+	c.recovered = info.ModTime()
+	c.keys = keys
+	if err := c.replay(f, info.Size()); err == errIsFinalized {
+		return true, nil
+	} else if err != nil {
+		report.Problems = append(report.Problems, Problem{File: file, Message: fmt.Sprintf("Cannot be recovered: %v", err)})
+		return false, nil
+	}
+	if c.version > formatVersion {
+		report.Problems = append(report.Problems, Problem{File: file, Message: fmt.Sprintf("Unsupported format version %v", c.version)})
+	}
+	if c.dropped > 0 {
+		report.Problems = append(report.Problems, Problem{File: file, Message: fmt.Sprintf("Recovery drops %v bytes at position %v: %v", c.dropped, c.size, c.dropReason), Recoverable: true})
+	}
+	var names []string
+	for n := range c.streams {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		s := c.streams[n]
+		problem := func(format string, args ...interface{}) {
+			report.Problems = append(report.Problems, Problem{File: file, Stream: n, Message: fmt.Sprintf(format, args...)})
+		}
+		size := s.offset + uint64(s.length)
+		if s.keepOffset > size {
+			problem("keepOffset %v is beyond the end %v", s.keepOffset, size)
+		}
+		if prev, ok := streams[n]; ok && !prev.deleted && !s.fresh {
+			if s.offset != prev.size {
+				problem("Starts at offset %v, but older logs end at %v", s.offset, prev.size)
+			}
+			if c.version != formatVersion1 && s.records != prev.records {
+				problem("Starts at record %v, but older logs end at record %v", s.records, prev.records)
+			}
+		} else if !s.fresh && s.offset > s.keepOffset && report.Unchecked == 0 {
+			// Older logs might hold the bytes, unless all of them have been checked
+			problem("Bytes before offset %v are missing", s.offset)
+		}
+		streams[n] = &checkedStream{size: size, records: s.records + uint64(len(s.recordEnds)), deleted: s.deleted}
+	}
+	return false, nil
+}
+
+// checkFinalizedLog checks a finalized log and cross-checks its streams.
+func checkFinalizedLog(storage Storage, fileName string, keys KeyProvider, streams map[string]*checkedStream, report *CheckReport) error {
+	file := filepath.Base(fileName)
+	problem := func(streamName string, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, Problem{File: file, Stream: streamName, Message: fmt.Sprintf(format, args...)})
+	}
+	if _, err := storage.Stat(fileName); err != nil {
+		return err
+	}
+	l := newLogReader(storage, fileName)
+	l.keys = keys
+	l.keepSealed = true
+	if err := l.open(); err != nil {
+		problem("", "Trailer or dict cannot be read: %v", err)
+		return nil
+	}
+	defer l.close()
+	if l.version > formatVersion {
+		problem("", "Unsupported format version %v", l.version)
+		return nil
+	}
+	if pos, err := l.verify(); err != nil {
+		problem("", "Action at position %v is corrupt: %v", pos, err)
+	}
+	if len(l.dict) > 0 && l.dict[0] == flagSealedDict {
+		// The dict cannot be decrypted without keys. Its streams are unknown,
+		// hence newer logs cannot be cross-checked with the older ones.
+		report.Unchecked++
+		for n := range streams {
+			delete(streams, n)
+		}
+		return nil
+	}
+	entries, err := l.checkDict()
+	if err != nil {
+		problem("", "Dict is corrupt: %v", err)
+		return nil
+	}
+	compacted := l.header.flags&headerCompacted != 0
+	for _, entry := range entries {
+		n, e := entry.streamName, entry.e
+		if l.filter != nil && !l.filter.mayContain(n) {
+			problem(n, "Missing in the filter")
+		}
+		if e.keep > e.span.To {
+			problem(n, "keepOffset %v is beyond the end %v", e.keep, e.span.To)
+		}
+		// The pieces must be stored in the actions of the log and cover the span without gaps
+		offset := e.span.From
+		for i := 0; i < e.pieceCount(); i++ {
+			p := e.piece(i)
+			if int64(p.pos) < l.start || int64(p.pos)+int64(p.stored) > l.end {
+				problem(n, "Piece %v at position %v is outside of the actions", i, p.pos)
+			}
+			if p.codec != 0 && !codecKnown(p.codec) {
+				problem(n, "Piece %v is compressed by the unknown codec %v", i, p.codec)
+			}
+			// Compressed or encrypted pieces are kept as a whole, hence the first one can start before the span
+			partial := i == 0 && p.encoded() && p.offset < offset && p.offset+uint64(p.length) > offset
+			if p.offset != offset && !partial {
+				problem(n, "Piece %v starts at offset %v instead of %v", i, p.offset, offset)
+			}
+			offset = p.offset + uint64(p.length)
+		}
+		if e.pieceCount() > 0 && offset != e.span.To {
+			problem(n, "Pieces end at offset %v instead of %v", offset, e.span.To)
+		}
+		end := e.records
+		for i := 0; i < e.recordCount(); i++ {
+			if r := e.recordEnd(i); r > e.span.To || (i > 0 && r < e.recordEnd(i-1)) {
+				problem(n, "Record %v ends at wrong offset %v", e.records+uint64(i), r)
+			}
+			end++
+		}
+
+		// Cross-check with the older logs
+		fresh := e.flags&entryFresh != 0
+		if prev, ok := streams[n]; ok && !prev.deleted && !fresh {
+			start := prev.size
+			if e.keep > start {
+				start = e.keep
+			}
+			if e.span.To < prev.size {
+				problem(n, "Ends at offset %v, but older logs end at %v", e.span.To, prev.size)
+			} else if e.span.From > start || (e.span.From < start && !compacted) {
+				// Compacted logs can overlap with older logs, if removing them failed
+				problem(n, "Starts at offset %v, but older logs end at %v", e.span.From, start)
+			}
+			if l.version != formatVersion1 && !compacted && e.records != prev.records {
+				problem(n, "Starts at record %v, but older logs end at record %v", e.records, prev.records)
+			}
+		} else if !fresh && e.span.From > e.keep && e.flags&entryDeleted == 0 && report.Unchecked == 0 {
+			problem(n, "Bytes before offset %v are missing", e.span.From)
+		}
+		streams[n] = &checkedStream{size: e.span.To, records: end, deleted: e.flags&entryDeleted != 0}
+	}
+	return nil
+}
+
+// checkedEntry is a dict entry found by checkDict.
+type checkedEntry struct {
+	streamName string
+	e          logReaderEntry
+}
+
+// checkDict walks the dict tree while checking its structure and returns its entries ordered by stream name.
+func (l *logReader) checkDict() (entries []checkedEntry, err error) {
+	if len(l.dict) == 0 || l.dict[0] != flagDict {
+		return nil, errChecksum
+	}
+	if len(l.dict) == 1 {
+		return nil, nil
+	}
+	// A corrupt dict can make entryAt read beyond the dict
+	defer func() {
+		if r := recover(); r != nil {
+			entries = nil
+			err = fmt.Errorf("Entry out of bounds: %v", r)
+		}
+	}()
+	visited := make(map[int]bool)
+	var walk func(pos int) error
+	walk = func(pos int) error {
+		if pos < 1 || pos+8 > len(l.dict) {
+			return fmt.Errorf("Position %v is out of bounds", pos)
+		}
+		if visited[pos] {
+			return fmt.Errorf("Position %v is referenced twice", pos)
+		}
+		visited[pos] = true
+		if left := int(binary.LittleEndian.Uint32(l.dict[pos:])); left != 0 {
+			if err := walk(left); err != nil {
+				return err
+			}
+		}
+		streamName, e := l.entryAt(pos)
+		if len(entries) > 0 && entries[len(entries)-1].streamName >= streamName {
+			return fmt.Errorf("Stream %v is not ordered", streamName)
+		}
+		entries = append(entries, checkedEntry{streamName: streamName, e: e})
+		if right := int(binary.LittleEndian.Uint32(l.dict[pos+4:])); right != 0 {
+			return walk(right)
+		}
+		return nil
+	}
+	if err := walk(1); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,191 @@
+package queue
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// A Codec compresses the payloads of appends.
+// Each append stores the ID of its codec in the log. Hence logs can be read
+// regardless of the configured compression, as long as the codec is registered.
+// A Codec must be safe for concurrent use.
+type Codec interface {
+	// ID identifies the codec in the log. The ID 0 denotes uncompressed payloads and must not be used.
+	ID() uint8
+	// Compress returns the compressed data.
+	Compress(data []byte) ([]byte, error)
+	// Decompress decompresses src into dst, which has the size of the uncompressed data.
+	Decompress(dst []byte, src []byte) error
+}
+
+// Deflate compresses payloads with DEFLATE (RFC 1951).
+var Deflate Codec = deflateCodec{}
+
+// Gzip compresses payloads with gzip (RFC 1952).
+var Gzip Codec = gzipCodec{}
+
+var errUnknownCodec = errors.New("Unknown codec")
+var errPayloadSize = errors.New("Decompressed payload has the wrong size")
+
+// Registered codecs by ID
+var codecs = map[uint8]Codec{1: Deflate, 2: Gzip}
+var codecsMutex sync.RWMutex
+
+// RegisterCodec makes a codec known, such that payloads compressed by it can be read.
+// It fails if the ID of the codec is 0 or is used by a codec of another type.
+// Registering a codec of the type already registered for its ID has no effect.
+func RegisterCodec(codec Codec) error {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	if codec.ID() == 0 {
+		return os.ErrExist
+	}
+	if c, ok := codecs[codec.ID()]; ok {
+		// Codecs are not necessarily comparable, hence their types are compared
+		if reflect.TypeOf(c) != reflect.TypeOf(codec) {
+			return os.ErrExist
+		}
+		return nil
+	}
+	codecs[codec.ID()] = codec
+	return nil
+}
+
+// decompress decompresses src into dst using the codec with the given ID.
+func decompress(codec uint8, dst []byte, src []byte) error {
+	codecsMutex.RLock()
+	c, ok := codecs[codec]
+	codecsMutex.RUnlock()
+	if !ok {
+		return errUnknownCodec
+	}
+	return c.Decompress(dst, src)
+}
+
+// codecKnown returns true if a codec with the given ID has been registered.
+func codecKnown(codec uint8) bool {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	_, ok := codecs[codec]
+	return ok
+}
+
+// readFull decompresses a stream into dst and fails if its size does not match.
+func readFull(r io.Reader, dst []byte) error {
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return err
+	}
+	var extra [1]byte
+	if n, _ := r.Read(extra[:]); n != 0 {
+		return errPayloadSize
+	}
+	return nil
+}
+
+type deflateCodec struct{}
+
+// Compressors are expensive to allocate, hence they are reused
+var deflateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+func (deflateCodec) ID() uint8 {
+	return 1
+}
+
+func (deflateCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := deflateWriters.Get().(*flate.Writer)
+	defer deflateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCodec) Decompress(dst []byte, src []byte) error {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readFull(r, dst)
+}
+
+type gzipCodec struct{}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+func (gzipCodec) ID() uint8 {
+	return 2
+}
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(dst []byte, src []byte) error {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return readFull(r, dst)
+}
+
+// SetCodec compresses the payloads of all streams whose name starts with prefix with the codec.
+// If several prefixes match a stream, the codec of the longest prefix applies.
+// Streams without a matching prefix use Options.Codec. Passing a nil codec removes the prefix.
+// The setting affects future appends only and is not persisted.
+// The codec is registered by RegisterCodec, which fails if its ID is used by a codec of another type.
+func (f *Frontend) SetCodec(prefix string, codec Codec) error {
+	if codec != nil {
+		if err := RegisterCodec(codec); err != nil {
+			return err
+		}
+	}
+	f.codecMutex.Lock()
+	defer f.codecMutex.Unlock()
+	if codec == nil {
+		delete(f.streamCodecs, prefix)
+	} else {
+		f.streamCodecs[prefix] = codec
+	}
+	return nil
+}
+
+// codecFor returns the codec compressing the payloads of the stream, or nil.
+func (f *Frontend) codecFor(streamName string) Codec {
+	f.codecMutex.Lock()
+	defer f.codecMutex.Unlock()
+	codec := f.options.Codec
+	longest := -1
+	for prefix, c := range f.streamCodecs {
+		if strings.HasPrefix(streamName, prefix) && len(prefix) > longest {
+			codec = c
+			longest = len(prefix)
+		}
+	}
+	return codec
+}
@@ -6,9 +6,11 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"hash/crc32"
 	"io"
 	"os"
 	"sort"
+	"time"
 
 	"github.com/weistn/byos/queue/util"
 )
@@ -22,48 +24,138 @@ const (
 	flagAppend  = 4
 	flagPollard = 8
 	flagDict    = 12
+	flagDelete  = 16
+	// An encrypted dict. It is followed by the ID of the key and the encrypted dict starting with flagDict.
+	flagSealedDict = 20
+	flagBatch      = 24
+)
+
+const (
+	// The format written by the first release. The log starts with the first action, without a header.
+	// Stream indices and fat counts are 16 bit, which limits a log to 65535 streams and appends.
+	// Actions and the dict have no checksums. Actions registering a stream store its offset only
+	// and dict entries store the offsets of the first kept and the last byte followed by the pieces.
+	// The trailer follows the dict immediately. testdata holds logs written by the first release.
+	// Logs of this format are recovered and finalized, but never appended to.
+	formatVersion1 = 1
+	// The log starts with a logHeader and all actions and the dict are followed by a checksum.
+	// Stream indices are varints. Actions registering a stream carry its keepOffset and the number of records
+	// that ended before. Append actions store their commit time and denote the codec and key encoding their data.
+	// Appends can be framed by a batchAction and streams can be deleted by a deleteAction.
+	// Dict entries start with entryFlags and store the stream offset, commit time and storage of each piece
+	// as well as the record index of the stream. The dict can be sealed and is followed by a logFilter.
+	formatVersion2 = 2
+	// The format written by this implementation.
+	formatVersion = formatVersion2
 )
 
 type streamLog struct {
 	// All streams written to the log are counted, startiung with
 	// 0 for the first stream.
 	// This is used to avoid serializing the same stream name twice.
-	number uint16
+	number uint32
 	// Index into the FAT
-	firstFatIndex uint16
-	lastFatIndex  uint16
+	firstFatIndex uint32
+	lastFatIndex  uint32
 	// The offset of the first stream byte serialized in the log.
 	offset uint64
-	// The offset of the first stream byte serialized in the log that should be kept.
-	// It always holds that offset <= keepOffset.
+	// The offset of the first stream byte that should be kept.
+	// This can be smaller than offset if the stream has been pollarded in an older log
+	// or if it has not been pollarded at all.
 	keepOffset uint64
 	// The number of stream bytes serialized in the log across all fat entries.
 	length int
+	// The number of records of the stream that ended before the stream has been written to the log.
+	records uint64
+	// The offsets following the last byte of all records ended in the log.
+	// Record number records+i ends at recordEnds[i].
+	recordEnds []uint64
+	// Indices of all fat entries of the stream, ordered by offset.
+	// Allows for a binary search of the fat entry holding a stream byte.
+	index []uint32
+	// True if the stream has been deleted and not been written to since
+	deleted bool
+	// True if the stream has been deleted in the log. Older logs hold no data of the stream.
+	fresh bool
 }
 
+type entryFlags uint8
+
+const (
+	// The stream has been deleted
+	entryDeleted entryFlags = 1 << iota
+	// The stream has been deleted and possibly recreated in the log. Older logs hold no data of the stream.
+	entryFresh
+)
+
 type fatEntry struct {
 	// Index into the FAT. A value of 0 means end of list.
-	next uint16
+	next uint32
 	// Position in the log where the stream bytes are serialized
 	pos int
 	// Number of stream bytes serialized at the given position in the log
 	length int
+	// The stream offset of the first byte serialized at the given position
+	offset uint64
+	// The commit time of the bytes, in nanoseconds since the epoch
+	time int64
+	// The ID of the codec that compressed the bytes, or 0 if they are not compressed
+	codec uint8
+	// The ID of the key that encrypted the bytes, or 0 if they are not encrypted
+	key uint32
+	// The number of bytes stored at the given position. It differs from length if the bytes are compressed or encrypted.
+	stored int
 }
 
 type commitLog struct {
 	// Maps stream names to an index.
 	// Stream names are indexed starting with 0 based on the order
 	// of the commits.
-	streams   map[string]streamLog
-	w         *writer
-	size      int
+	streams map[string]streamLog
+	w       *writer
+	size    int
+	// The size of the log when it has been synced the last time.
+	synced    int
 	fat       []fatEntry
 	finalized bool
+	// The format version of the log
+	version uint8
+	// The id and flags of the log. They must be set before calling create.
+	// The id is written to the header when the log is recovered without having a header.
+	id    uint64
+	flags headerFlags
+	// The number of the oldest log file merged by the compaction writing the log, or id.
+	// It must be set before calling create.
+	first uint64
+	// Set if finalizing failed and the partial dict could not be removed. The log takes no more actions then.
+	failed error
+	// The time when the log has been created or recovered.
+	created time.Time
+	// The time assigned to recovered appends of formatVersion1,
+	// since they do not store their commit time.
+	// This is the modification time of the file, which no append can be younger than.
+	recovered time.Time
+	// The most recent commit time assigned to an append. Commit times are strictly increasing.
+	lastTime int64
+	// Holds the log file
+	storage Storage
+	// Supplies the keys to encrypt and decrypt data, or nil
+	keys KeyProvider
+	// Number of bytes dropped from the end of the log by recover.
+	dropped int64
+	// The reason why recover stopped before the end of the log, or nil.
+	dropReason error
 }
 
 type action struct {
-	flags      actionFlags
-	offset     uint64
+	flags  actionFlags
+	offset uint64
+	// The keepOffset of the stream known from older logs.
+	// It is only serialized when the stream is written to the log for the first time.
+	keepOffset uint64
+	// The number of records of the stream known from older logs.
+	// It is only serialized when the stream is written to the log for the first time.
+	records    uint64
 	streamName string
 }
 
@@ -76,6 +168,15 @@ type actionIface interface {
 type appendAction struct {
 	a    action
 	data []byte
+	// The commit time in nanoseconds since the epoch. If it is 0 when the action is written,
+	// the commit log assigns the current time.
+	time int64
+	// The ID of the codec that compressed data, or 0 if data is not compressed
+	codec uint8
+	// The ID of the key that encrypted data, or 0 if data is not encrypted
+	key uint32
+	// The number of stream bytes compressed or encrypted into data. Only used if codec or key is not 0.
+	size int
 }
 
 type pollardAction struct {
@@ -83,112 +184,356 @@ type pollardAction struct {
 	pollardPos uint64
 }
 
+// The deleteAction deletes a stream. Writing to the stream afterwards creates a new stream.
+type deleteAction struct {
+	a action
+}
+
+// The batchAction frames appends, possibly to different streams, which are recovered all or none.
+// It consists of the number of appends followed by the appends without their checksums.
+// A single checksum protects the whole batch.
+type batchAction struct {
+	appends []appendAction
+}
+
 type reader struct {
 	b     *bufio.Reader
 	names []string
+	// The format version of the log being read
+	version uint8
+	// Checksum of all bytes read since the last call to resetChecksum
+	crc uint32
+	// Number of bytes left to read, or -1 if unknown.
+	// Used to reject corrupted lengths before allocating memory for them.
+	left int64
 }
 
+// The writer buffers data written to the log.
+// Buffered data can be read before it has been flushed to the file.
 type writer struct {
-	b *bufio.Writer
-	f *os.File
+	f File
+	// Data that has not been flushed to the file yet
+	buf []byte
+	// The position in the file where buf starts
+	pos int64
+	// Checksum of all bytes written since the last call to resetChecksum
+	crc uint32
 }
 
+// Each action is followed by a CRC32C checksum over all bytes of the action.
+// The dict is followed by a checksum as well. Logs of formatVersion1 have no checksums.
+const checksumSize = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// The writer flushes its buffer once it exceeds this size.
+const writerBufferSize = 64 << 10
+
 var errIsFinalized = errors.New("The commit log is finalized")
+var errChecksum = errors.New("Checksum mismatch")
+var errUnknownAction = errors.New("Unknown action")
+var errUnsupportedFormat = errors.New("Unsupported log format")
+var errStreamDeleted = errors.New("The stream has been deleted")
+var errIncompleteDict = errors.New("The dict is incomplete")
 
-func newCommitLog() *commitLog {
+func newCommitLog(storage Storage) *commitLog {
 	// TODO: Writer
-	return &commitLog{streams: make(map[string]streamLog)}
+	return &commitLog{streams: make(map[string]streamLog), storage: storage}
 }
 
 func (c *commitLog) create(filename string) error {
-	f, err := os.Create(filename)
+	f, err := c.storage.Create(filename)
+	if err != nil {
+		return err
+	}
+	c.w = newWriter(f, 0)
+	return c.writeHeader()
+}
+
+// writeHeader writes the header to the empty log.
+func (c *commitLog) writeHeader() error {
+	c.version = formatVersion
+	c.created = time.Now()
+	if c.flags&headerCompacted == 0 {
+		c.first = c.id
+	}
+	h := logHeader{version: c.version, flags: c.flags, id: c.id, created: c.created, first: c.first}
+	if _, err := c.w.Write(h.marshal()); err != nil {
+		return err
+	}
+	if err := c.w.Sync(); err != nil {
+		return err
+	}
+	c.size = headerSize
+	c.synced = c.size
+	return nil
+}
+
+// recoverHeader reads the header of the log, if there is any.
+// Otherwise the log has been written by an older version of this implementation.
+func (c *commitLog) recoverHeader(r *reader) error {
+	buf, err := r.b.Peek(headerSize)
+	if !hasHeaderMagic(buf) {
+		// Logs without a header have the first format version
+		c.version = formatVersion1
+		return nil
+	}
 	if err != nil {
+		// Writing the header has been interrupted
+		return io.ErrUnexpectedEOF
+	}
+	var h logHeader
+	if err := h.unmarshal(buf); err != nil {
 		return err
 	}
-	c.w = newWriter(f)
+	r.b.Discard(headerSize)
+	r.consumed(headerSize)
+	r.version = h.version
+	c.version = h.version
+	c.flags = h.flags
+	c.id = h.id
+	c.first = h.first
+	c.created = h.created
+	c.size = headerSize
 	return nil
 }
 
 func (c *commitLog) recover(fileName string) error {
 	// Determine size of the file
-	fileInfo, err := os.Stat(fileName)
+	fileInfo, err := c.storage.Stat(fileName)
 	if err != nil {
 		return err
 	}
 	size := fileInfo.Size()
+	c.recovered = fileInfo.ModTime()
 
 	// Open the file for read/write
-	f, err := os.OpenFile(fileName, os.O_RDWR, 0755)
+	f, err := c.storage.OpenWrite(fileName)
 	if err != nil {
 		return err
 	}
 
-	r := newReader(f)
-	// Read all committed actions until end of file
-	for int64(c.size) < size {
-		a, err := r.peekAction()
-		if err != nil {
-			break
+	if err := c.replay(f, size); err != nil {
+		f.Close()
+		return err
+	}
+	// From here on we see garbage. Truncate here and continue
+	if c.dropped > 0 {
+		if err := f.Truncate(int64(c.size)); err != nil {
+			f.Close()
+			return err
 		}
-		switch a & flagMask {
-		case flagAppend:
-			var a appendAction
-			err = a.read(r)
-			if err != nil {
-				break
-			}
-			n, err := a.recover(c)
-			if err != nil {
-				break
-			}
-			c.size += n
-		case flagPollard:
-			var a pollardAction
-			err = a.read(r)
-			if err != nil {
-				break
-			}
-			n, err := a.recover(c)
-			if err != nil {
+	}
+	c.synced = c.size
+
+	// Append new actions using the writer.
+	c.w = newWriter(f, int64(c.size))
+	if c.size == 0 {
+		// Nothing has been written so far, not even the header
+		return c.writeHeader()
+	}
+	if c.dropReason == errIncompleteDict {
+		// Complete the interrupted finalize
+		if err := c.finalize(); err != nil {
+			return err
+		}
+		return errIsFinalized
+	}
+	if c.version == formatVersion1 {
+		// The file does not tell when it has been created, hence the age of the log starts now.
+		c.created = time.Now()
+	}
+	return nil
+}
+
+// replay applies the actions of the log file to the commit log without modifying the file.
+// It stops at the first action that cannot be parsed or has a wrong checksum.
+// Afterwards size is the size of the intact part of the file and dropped is the number of bytes following it.
+// It returns errIsFinalized if the log is finalized.
+func (c *commitLog) replay(f File, size int64) error {
+	r := newSizedReader(io.NewSectionReader(f, 0, size), size)
+	if err := c.recoverHeader(r); err == io.ErrUnexpectedEOF && size < headerSize {
+		// The log has been created but writing the header has not completed
+		c.dropReason = err
+		c.dropped = size
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// Read all committed actions until end of file or until the first
+	// action that cannot be parsed or has a wrong checksum.
+	for int64(c.size) < size {
+		n, err := c.recoverAction(r)
+		if err == errIsFinalized {
+			if err := c.checkDict(f, int64(c.size), size); err != nil {
+				// Finalizing has not completed. The dict is rebuilt from the actions
+				c.dropReason = errIncompleteDict
 				break
 			}
-			c.size += n
-		case flagDict:
-			// TODO: Check that the dict is ok
 			c.finalized = true
 			return errIsFinalized
-		default:
+		}
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = io.ErrUnexpectedEOF
+			}
+			c.dropReason = err
 			break
 		}
+		c.size += n
 	}
+	c.dropped = size - int64(c.size)
+	return nil
+}
 
-	// From here on we see garbage. Truncate here and continue
-	if int64(c.size) != size {
-		f.Truncate(int64(c.size))
+// checkDict returns nil if the log file holds a complete dict, filter and trailer starting at pos.
+func (c *commitLog) checkDict(f File, pos int64, size int64) error {
+	l := newLogReader(c.storage, f.Name())
+	l.version = c.version
+	l.start = pos
+	dictPos, dictSize, err := l.readTrailer(f, size)
+	if err != nil {
+		return err
+	}
+	if dictPos != pos {
+		return errIncompleteDict
 	}
+	if err := l.readDict(f, dictPos, dictSize); err != nil {
+		return err
+	}
+	if err := l.readFilter(f, dictPos, dictSize); err != nil {
+		return err
+	}
+	l.keys = c.keys
+	if err := l.openDict(); err != nil {
+		// The checksum tells that the dict is complete, but its structure cannot be checked without the key
+		return nil
+	}
+	_, err = l.checkDict()
+	return err
+}
 
-	// Append new actions using the writer
-	c.w = newWriter(f)
-	return nil
+// recoverAction reads the next action, verifies its checksum and applies it to the commit log.
+// It returns the number of bytes consumed by the action.
+func (c *commitLog) recoverAction(r *reader) (n int, err error) {
+	flags, err := r.peekAction()
+	if err != nil {
+		return 0, err
+	}
+	r.resetChecksum()
+	switch flags & flagMask {
+	case flagAppend:
+		var a appendAction
+		if err = a.read(r); err != nil {
+			return 0, err
+		}
+		if err = r.verifyChecksum(); err != nil {
+			return 0, err
+		}
+		n, err = a.recover(c)
+	case flagPollard:
+		var a pollardAction
+		if err = a.read(r); err != nil {
+			return 0, err
+		}
+		if err = r.verifyChecksum(); err != nil {
+			return 0, err
+		}
+		n, err = a.recover(c)
+	case flagDelete:
+		var a deleteAction
+		if err = a.read(r); err != nil {
+			return 0, err
+		}
+		if err = r.verifyChecksum(); err != nil {
+			return 0, err
+		}
+		n, err = a.recover(c)
+	case flagBatch:
+		// The appends of a batch are only applied once all of them have been read and verified
+		var a batchAction
+		if err = a.read(r); err != nil {
+			return 0, err
+		}
+		if err = r.verifyChecksum(); err != nil {
+			return 0, err
+		}
+		n, err = a.recover(c)
+	case flagDict, flagSealedDict:
+		return 0, errIsFinalized
+	default:
+		return 0, errUnknownAction
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n + checksumSizeOf(c.version), nil
+}
+
+// checksumSizeOf returns the size of the checksums following the actions and the dict of a log of the given format.
+func checksumSizeOf(version uint8) int {
+	if version == formatVersion1 {
+		return 0
+	}
+	return checksumSize
 }
 
 func (c *commitLog) close() error {
 	if c.finalized {
 		return errIsFinalized
 	}
+	// Persist actions that have not been synced yet
+	if err := c.w.Sync(); err != nil {
+		c.w.f.Close()
+		return err
+	}
 	return c.w.f.Close()
 }
 
+// commit writes the action to the log and syncs it to disk.
 func (c *commitLog) commit(a actionIface) error {
+	if err := c.append(a); err != nil {
+		return err
+	}
+	if err := c.w.Sync(); err != nil {
+		return err
+	}
+	c.synced = c.size
+	return nil
+}
+
+// commitTime returns the commit time for an append, which is the current time
+// unless this is not later than the commit time of the previous append.
+func (c *commitLog) commitTime() int64 {
+	t := time.Now().UnixNano()
+	if t <= c.lastTime {
+		t = c.lastTime + 1
+	}
+	c.lastTime = t
+	return t
+}
+
+// append writes the action to the log without syncing it to disk.
+// Logs of an older format are only finalized, hence they cannot be appended to.
+func (c *commitLog) append(a actionIface) error {
 	if c.finalized {
 		return errIsFinalized
 	}
+	if c.failed != nil {
+		return c.failed
+	}
+	if c.version != formatVersion {
+		return errUnsupportedFormat
+	}
+	c.w.resetChecksum()
 	n, err := a.write(c)
 	if err != nil {
 		return err
 	}
-	c.size += n
-	c.w.Sync()
+	if err = c.w.writeChecksum(); err != nil {
+		return err
+	}
+	c.size += n + checksumSize
 	return nil
 }
 
@@ -196,6 +541,9 @@ func (c *commitLog) finalize() error {
 	if c.finalized {
 		return errIsFinalized
 	}
+	if c.failed != nil {
+		return c.failed
+	}
 
 	// Sorted list of stream names
 	var names []string
@@ -211,9 +559,47 @@ func (c *commitLog) finalize() error {
 	buf.WriteByte(byte(flagDict))
 
 	// Write the tree
-	c.writeDictSubtree(buf, names)
+	if _, err := c.writeDictSubtree(buf, names); err != nil {
+		return err
+	}
+
+	// Encrypt the dict
+	if c.keys != nil && c.version != formatVersion1 {
+		id, err := c.keys.DictKey()
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			sealed, err := sealData(c.keys, id, buf.Bytes(), dictAAD(c.id))
+			if err != nil {
+				return err
+			}
+			var b [5]byte
+			b[0] = byte(flagSealedDict)
+			binary.LittleEndian.PutUint32(b[1:], id)
+			buf = bytes.NewBuffer(nil)
+			buf.Write(b[:])
+			buf.Write(sealed)
+		}
+	}
+
+	// Protect the dict with a checksum
+	var crc [checksumSize]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.Checksum(buf.Bytes(), crcTable))
+	buf.Write(crc[:checksumSizeOf(c.version)])
 
-	// Write size of dict and magic number
+	// Write the filter, its checksum and its size
+	if c.version != formatVersion1 {
+		start := buf.Len()
+		newLogFilter(names).marshal(buf)
+		binary.LittleEndian.PutUint32(crc[:], crc32.Checksum(buf.Bytes()[start:], crcTable))
+		buf.Write(crc[:])
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(buf.Len()-start))
+		buf.Write(size[:])
+	}
+
+	// Write size of dict and filter and magic number
 	trailer := [16]byte{0, 0, 0, 0, 0, 0, 0, 0, 42, 0, 42, 0, 42, 0xff, 42, 0xff}
 	binary.LittleEndian.PutUint64(trailer[:], uint64(buf.Len()))
 	if _, err := buf.Write(trailer[:]); err != nil {
@@ -221,13 +607,16 @@ func (c *commitLog) finalize() error {
 	}
 
 	// Persist the tree
-	if _, err := c.w.b.Write(buf.Bytes()); err != nil {
-		return err
+	_, err := c.w.Write(buf.Bytes())
+	if err == nil {
+		err = c.w.Sync()
 	}
-	if err := c.w.b.Flush(); err != nil {
-		return err
-	}
-	if err := c.w.f.Sync(); err != nil {
+	if err != nil {
+		// Drop the partial dict, such that the log can still be appended to and finalized later
+		if err2 := c.w.truncate(int64(c.size)); err2 != nil {
+			// Appends would follow the partial dict and be dropped by the recovery
+			c.failed = err2
+		}
 		return err
 	}
 
@@ -256,56 +645,88 @@ func (c *commitLog) writeDictSubtree(buf *bytes.Buffer, names []string) (pos int
 	if err := buf.WriteByte(0); err != nil {
 		return 0, err
 	}
-
-	// Write information about the stream
-	// Count fat entries
-	var fatCount uint16
-	fatIndex := s.firstFatIndex
-	foffset := s.offset
-	for {
-		if c.fat[fatIndex].length > 0 {
-			if foffset+uint64(c.fat[fatIndex].length) > s.keepOffset {
-				fatCount++
-			}
-			foffset += uint64(c.fat[fatIndex].length)
+	if c.version != formatVersion1 {
+		var flags entryFlags
+		if s.deleted {
+			flags |= entryDeleted
 		}
-		if c.fat[fatIndex].next == 0 {
-			break
+		if s.fresh {
+			flags |= entryFresh
+		}
+		if err := buf.WriteByte(byte(flags)); err != nil {
+			return 0, err
 		}
-		fatIndex = c.fat[fatIndex].next
 	}
 
-	// Write offset of first and last byte, and write number of fat entries
-	var fatBuf [18]byte
-	binary.LittleEndian.PutUint64(fatBuf[:8], s.keepOffset)
-	binary.LittleEndian.PutUint64(fatBuf[8:16], s.offset+uint64(s.length))
-	binary.LittleEndian.PutUint16(fatBuf[16:18], fatCount)
-	if _, err := buf.Write(fatBuf[:]); err != nil {
+	// Write information about the stream
+	pieces := c.keptPieces(&s)
+
+	// Write the keepOffset, the offset of the first and last byte, and write number of fat entries
+	var fatBuf [28]byte
+	var fatBufLen int
+	span := s.dataSpan()
+	if c.version == formatVersion1 {
+		// The first format stores the range of kept bytes and a 16 bit count only
+		binary.LittleEndian.PutUint64(fatBuf[:8], span.From)
+		binary.LittleEndian.PutUint64(fatBuf[8:16], span.To)
+		binary.LittleEndian.PutUint16(fatBuf[16:18], uint16(len(pieces)))
+		fatBufLen = 18
+	} else {
+		binary.LittleEndian.PutUint64(fatBuf[:8], s.keepOffset)
+		binary.LittleEndian.PutUint64(fatBuf[8:16], span.From)
+		binary.LittleEndian.PutUint64(fatBuf[16:24], span.To)
+		binary.LittleEndian.PutUint32(fatBuf[24:28], uint32(len(pieces)))
+		fatBufLen = 28
+	}
+	if _, err := buf.Write(fatBuf[:fatBufLen]); err != nil {
 		return 0, err
 	}
 
 	// Write fat entries
-	fatIndex = s.firstFatIndex
-	foffset = s.offset
-	for {
-		if c.fat[fatIndex].length > 0 {
-			if foffset+uint64(c.fat[fatIndex].length) > s.keepOffset {
-				var skip uint32
-				if foffset < s.keepOffset {
-					skip = uint32(s.keepOffset - foffset)
-				}
-				binary.LittleEndian.PutUint32(fatBuf[:4], uint32(c.fat[fatIndex].pos)+skip)
-				binary.LittleEndian.PutUint32(fatBuf[4:8], uint32(c.fat[fatIndex].length)-skip)
-				if _, err := buf.Write(fatBuf[:8]); err != nil {
-					return 0, err
-				}
+	for _, p := range pieces {
+		binary.LittleEndian.PutUint32(fatBuf[:4], uint32(p.fat.pos)+p.skip)
+		binary.LittleEndian.PutUint32(fatBuf[4:8], uint32(p.fat.length)-p.skip)
+		l := 8
+		if c.version != formatVersion1 {
+			binary.LittleEndian.PutUint64(fatBuf[8:16], p.offset)
+			l += 8
+		}
+		if _, err := buf.Write(fatBuf[:l]); err != nil {
+			return 0, err
+		}
+	}
+
+	if c.version != formatVersion1 {
+		// Write the commit times of the fat entries
+		for _, p := range pieces {
+			binary.LittleEndian.PutUint64(fatBuf[:8], uint64(p.fat.time))
+			if _, err := buf.Write(fatBuf[:8]); err != nil {
+				return 0, err
 			}
-			foffset += uint64(c.fat[fatIndex].length)
 		}
-		if c.fat[fatIndex].next == 0 {
-			break
+
+		// Write how the fat entries are stored
+		for _, p := range pieces {
+			binary.LittleEndian.PutUint32(fatBuf[:4], uint32(p.fat.stored)-p.skip)
+			fatBuf[4] = p.fat.codec
+			binary.LittleEndian.PutUint32(fatBuf[5:9], p.fat.key)
+			if _, err := buf.Write(fatBuf[:pieceStorageSize]); err != nil {
+				return 0, err
+			}
+		}
+
+		// Write the record index
+		binary.LittleEndian.PutUint64(fatBuf[:8], s.records)
+		binary.LittleEndian.PutUint32(fatBuf[8:12], uint32(len(s.recordEnds)))
+		if _, err := buf.Write(fatBuf[:12]); err != nil {
+			return 0, err
+		}
+		for _, end := range s.recordEnds {
+			binary.LittleEndian.PutUint64(fatBuf[:8], end)
+			if _, err := buf.Write(fatBuf[:8]); err != nil {
+				return 0, err
+			}
 		}
-		fatIndex = c.fat[fatIndex].next
 	}
 
 	// Write positions of left and write subtree
@@ -327,14 +748,112 @@ func (c *commitLog) writeDictSubtree(buf *bytes.Buffer, names []string) (pos int
 	return pos, nil
 }
 
+// A dictPiece is a fat entry holding stream bytes that have not been pollarded, as it is written to the dict.
+type dictPiece struct {
+	fat *fatEntry
+	// The number of pollarded bytes at the beginning of the fat entry which are not kept
+	skip uint32
+	// The stream offset of the first kept byte
+	offset uint64
+}
+
+// keptPieces returns the fat entries of the stream holding bytes that have not been pollarded.
+func (c *commitLog) keptPieces(s *streamLog) []dictPiece {
+	var pieces []dictPiece
+	// Streams which have only been pollarded in this log have no fat entries
+	fatIndex := s.firstFatIndex
+	foffset := s.offset
+	for s.length > 0 {
+		fat := &c.fat[fatIndex]
+		if fat.length > 0 {
+			if foffset+uint64(fat.length) > s.keepOffset {
+				var skip uint32
+				// Compressed or encrypted bytes cannot be split. They are kept as a whole
+				if foffset < s.keepOffset && !fat.encoded() {
+					skip = uint32(s.keepOffset - foffset)
+				}
+				pieces = append(pieces, dictPiece{fat: fat, skip: skip, offset: foffset + uint64(skip)})
+			}
+			foffset += uint64(fat.length)
+		}
+		if fat.next == 0 {
+			break
+		}
+		fatIndex = fat.next
+	}
+	return pieces
+}
+
+// dataSpan returns the range of stream bytes serialized in the log that have not been pollarded.
+func (s *streamLog) dataSpan() util.Span {
+	from := s.offset
+	if s.keepOffset > from {
+		from = s.keepOffset
+	}
+	return util.Span{From: from, To: s.offset + uint64(s.length)}
+}
+
 // Returns the range of the stream that is stored in the log.
 // Returns an error if the stream is not in the log.
 func (c *commitLog) streamRange(streamName string) (span util.Span, err error) {
 	s, ok := c.streams[streamName]
 	if !ok {
 		return util.Span{}, os.ErrNotExist
+	} else if s.deleted {
+		return util.Span{}, errStreamDeleted
 	}
-	return util.Span{From: s.keepOffset, To: s.offset + uint64(s.length)}, nil
+	return s.dataSpan(), nil
+}
+
+// Returns the offset of the first stream byte that has not been pollarded.
+// Returns an error if the stream is not in the log.
+func (c *commitLog) streamKeepOffset(streamName string) (uint64, error) {
+	s, ok := c.streams[streamName]
+	if !ok {
+		return 0, os.ErrNotExist
+	} else if s.deleted {
+		return 0, errStreamDeleted
+	}
+	return s.keepOffset, nil
+}
+
+// Returns the number of records that ended before the stream has been written to the log
+// and the ends of the records ended in the log.
+// Returns an error if the stream is not in the log.
+func (c *commitLog) streamRecords(streamName string) (records uint64, ends []uint64, err error) {
+	s, ok := c.streams[streamName]
+	if !ok {
+		return 0, nil, os.ErrNotExist
+	} else if s.deleted {
+		return 0, nil, errStreamDeleted
+	}
+	return s.records, s.recordEnds, nil
+}
+
+// streamExpiry returns the offset of the first stream byte in the log that has been appended at or after t,
+// or the offset following the stream bytes in the log if all of them have been appended before.
+// expired is true if some stream bytes in the log have been appended before t.
+// Appends are timestamped in the order of their offsets, hence the expired bytes are a prefix.
+// Returns an error if the stream is not in the log.
+func (c *commitLog) streamExpiry(streamName string, t time.Time) (offset uint64, expired bool, err error) {
+	s, ok := c.streams[streamName]
+	if !ok {
+		return 0, false, os.ErrNotExist
+	} else if s.deleted {
+		return 0, false, errStreamDeleted
+	}
+	i := sort.Search(len(s.index), func(i int) bool {
+		return c.fat[s.index[i]].time >= t.UnixNano()
+	})
+	if i == len(s.index) {
+		return s.offset + uint64(s.length), i > 0, nil
+	}
+	return c.fat[s.index[i]].offset, i > 0, nil
+}
+
+// streamFresh returns true if the stream has been deleted in the log, i.e. older logs hold no data of the stream.
+func (c *commitLog) streamFresh(streamName string) bool {
+	return c.streams[streamName].fresh
 }
 
 func (c *commitLog) readStream(streamName string, offset uint64, data []byte) (n int, err error) {
@@ -342,64 +861,209 @@ func (c *commitLog) readStream(streamName string, offset uint64, data []byte) (n
 	if !ok {
 		return 0, os.ErrNotExist
 	}
-	if offset < s.keepOffset || offset+uint64(len(data)) > s.offset+uint64(s.length) {
+	if span := s.dataSpan(); offset < span.From || offset+uint64(len(data)) > span.To {
 		return 0, os.ErrInvalid
 	}
-	findex := s.firstFatIndex
-	foffset := s.offset
-	for offset >= foffset+uint64(c.fat[findex].length) {
-		if c.fat[findex].next == 0 {
-			panic("Oooops")
-		}
-		foffset += uint64(c.fat[findex].length)
-		findex = c.fat[findex].next
-	}
+	// Search the first fat entry that ends behind offset
+	i := sort.Search(len(s.index), func(i int) bool {
+		f := &c.fat[s.index[i]]
+		return f.offset+uint64(f.length) > offset
+	})
 	toRead := len(data)
 	done := 0
-	for toRead > 0 {
-		pos := c.fat[findex].pos
-		posOffset := int(offset - foffset)
-		readCount := c.fat[findex].length - posOffset
+	for ; toRead > 0; i++ {
+		f := &c.fat[s.index[i]]
+		posOffset := int(offset - f.offset)
+		readCount := f.length - posOffset
 		if readCount > toRead {
 			readCount = toRead
 		}
-		n2, err := c.w.f.ReadAt(data[done:done+readCount], int64(pos+posOffset))
+		if f.encoded() {
+			// Compressed or encrypted bytes can only be decoded as a whole
+			raw, err := c.readEncoded(streamName, f)
+			if err != nil {
+				return 0, err
+			}
+			copy(data[done:done+readCount], raw[posOffset:])
+			toRead -= readCount
+			done += readCount
+			offset += uint64(readCount)
+			continue
+		}
+		n2, err := c.w.readAt(data[done:done+readCount], int64(f.pos+posOffset))
 		if err != nil {
-			return 0, nil
+			return 0, err
 		}
 		toRead -= n2
 		done += n2
 		offset += uint64(readCount)
-		foffset += uint64(c.fat[findex].length)
-		findex = c.fat[findex].next
 	}
 	return done, nil
 }
 
+// readEncoded reads, decrypts and decompresses the stream bytes of a fat entry of the stream.
+func (c *commitLog) readEncoded(streamName string, f *fatEntry) ([]byte, error) {
+	stored := make([]byte, f.stored)
+	if _, err := c.w.readAt(stored, int64(f.pos)); err != nil {
+		return nil, err
+	}
+	return decodePayload(c.keys, f.key, f.codec, stored, f.length, streamName, f.offset)
+}
+
+// encoded returns true if the bytes of the fat entry are compressed or encrypted.
+func (f *fatEntry) encoded() bool {
+	return f.codec != 0 || f.key != 0
+}
+
 func newReader(f io.Reader) *reader {
-	r := &reader{b: bufio.NewReader(f)}
+	r := &reader{b: bufio.NewReader(f), left: -1, version: formatVersion1}
+	return r
+}
+
+// newSizedReader returns a reader that knows that only size bytes can be read from f.
+func newSizedReader(f io.Reader, size int64) *reader {
+	r := &reader{b: bufio.NewReader(f), left: size, version: formatVersion1}
 	return r
 }
 
+// consumed updates the number of bytes left to read.
+func (r *reader) consumed(n int) {
+	if r.left >= 0 {
+		r.left -= int64(n)
+	}
+}
+
+// canRead returns false if it is known that less than n bytes are left to read.
+func (r *reader) canRead(n int) bool {
+	return r.left < 0 || int64(n) <= r.left
+}
+
 func (r *reader) peekAction() (actionFlags, error) {
+	b, err := r.b.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return actionFlags(b[0]), nil
+}
+
+func (r *reader) resetChecksum() {
+	r.crc = 0
+}
+
+func (r *reader) readByte() (byte, error) {
 	b, err := r.b.ReadByte()
 	if err != nil {
 		return 0, err
 	}
-	err = r.b.UnreadByte()
+	r.consumed(1)
+	r.crc = crc32.Update(r.crc, crcTable, []byte{b})
+	return b, nil
+}
+
+func (r *reader) readFull(buf []byte) error {
+	if _, err := io.ReadFull(r.b, buf); err != nil {
+		return err
+	}
+	r.consumed(len(buf))
+	r.crc = crc32.Update(r.crc, crcTable, buf)
+	return nil
+}
+
+func (r *reader) readString(delim byte) (string, error) {
+	str, err := r.b.ReadString(delim)
 	if err != nil {
-		panic("Oooops")
+		return "", err
 	}
-	return actionFlags(b), nil
+	r.consumed(len(str))
+	r.crc = crc32.Update(r.crc, crcTable, []byte(str))
+	return str, nil
 }
 
-func newWriter(f *os.File) *writer {
-	w := &writer{f: f, b: bufio.NewWriter(f)}
+// verifyChecksum reads the checksum that follows an action and compares it
+// with the checksum of all bytes read since the last call to resetChecksum.
+// Logs of formatVersion1 have no checksums.
+func (r *reader) verifyChecksum() error {
+	if checksumSizeOf(r.version) == 0 {
+		return nil
+	}
+	var buffer [checksumSize]byte
+	if _, err := io.ReadFull(r.b, buffer[:]); err != nil {
+		return err
+	}
+	r.consumed(checksumSize)
+	if binary.LittleEndian.Uint32(buffer[:]) != r.crc {
+		return errChecksum
+	}
+	return nil
+}
+
+func newWriter(f File, pos int64) *writer {
+	w := &writer{f: f, pos: pos, buf: make([]byte, 0, writerBufferSize)}
 	return w
 }
 
+// Write appends to the buffer and flushes it once it is full.
+func (w *writer) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= writerBufferSize {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *writer) resetChecksum() {
+	w.crc = 0
+}
+
+func (w *writer) write(p []byte) (int, error) {
+	n, err := w.Write(p)
+	w.crc = crc32.Update(w.crc, crcTable, p[:n])
+	return n, err
+}
+
+func (w *writer) writeByte(b byte) error {
+	if _, err := w.Write([]byte{b}); err != nil {
+		return err
+	}
+	w.crc = crc32.Update(w.crc, crcTable, []byte{b})
+	return nil
+}
+
+// writeChecksum writes the checksum of all bytes written since the last call to resetChecksum.
+func (w *writer) writeChecksum() error {
+	var buffer [checksumSize]byte
+	binary.LittleEndian.PutUint32(buffer[:], w.crc)
+	_, err := w.Write(buffer[:])
+	return err
+}
+
+// Flush writes buffered data to the file without syncing it to disk.
+func (w *writer) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	n, err := w.f.WriteAt(w.buf, w.pos)
+	w.pos += int64(n)
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	return err
+}
+
+// truncate drops all bytes at pos and behind, whether they have been flushed or not.
+func (w *writer) truncate(pos int64) error {
+	if pos >= w.pos {
+		w.buf = w.buf[:pos-w.pos]
+		// A failed flush might have written some bytes behind w.pos
+		return w.f.Truncate(w.pos)
+	}
+	w.buf = w.buf[:0]
+	w.pos = pos
+	return w.f.Truncate(pos)
+}
+
 func (w *writer) Sync() error {
-	err := w.b.Flush()
+	err := w.Flush()
 	if err != nil {
 		return err
 	}
@@ -407,6 +1071,27 @@ func (w *writer) Sync() error {
 	return err
 }
 
+// readAt reads data from the file or from the buffer if it has not been flushed yet.
+func (w *writer) readAt(p []byte, pos int64) (n int, err error) {
+	if pos < w.pos {
+		l := len(p)
+		if pos+int64(l) > w.pos {
+			l = int(w.pos - pos)
+		}
+		if n, err = w.f.ReadAt(p[:l], pos); err != nil {
+			return n, err
+		}
+		pos += int64(n)
+	}
+	if n < len(p) {
+		if pos-w.pos+int64(len(p)-n) > int64(len(w.buf)) {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copy(p[n:], w.buf[pos-w.pos:])
+	}
+	return n, nil
+}
+
 func encodeStreamName(name string, offset uint64) string {
 	var buffer [8]byte
 	binary.BigEndian.PutUint64(buffer[:], offset)
@@ -414,35 +1099,37 @@ func encodeStreamName(name string, offset uint64) string {
 }
 
 func (a *action) write(c *commitLog) (n int, err error) {
-	var buffer [9]byte
+	var buffer [25]byte
 	var n2 int
 	flags := a.flags
 	if s, ok := c.streams[a.streamName]; ok {
 		// Write flag and stream index
 		buffer[0] = byte(flags)
-		binary.LittleEndian.PutUint16(buffer[1:], s.number)
-		if n2, err = c.w.b.Write(buffer[:3]); err != nil {
+		l := 1 + putStreamIndex(c.version, buffer[1:], s.number)
+		if n2, err = c.w.write(buffer[:l]); err != nil {
 			return
 		}
 		n += n2
 	} else {
-		index := uint16(len(c.streams))
-		c.streams[a.streamName] = streamLog{number: index, offset: a.offset, keepOffset: a.offset}
-		// Write flags anf offset
+		index := uint32(len(c.streams))
+		c.streams[a.streamName] = streamLog{number: index, offset: a.offset, keepOffset: a.keepOffset, records: a.records}
+		// Write flags, offset, keepOffset and the number of records
 		flags |= actionWithName
 		buffer[0] = byte(flags)
 		binary.LittleEndian.PutUint64(buffer[1:], a.offset)
-		if _, err = c.w.b.Write(buffer[:9]); err != nil {
+		binary.LittleEndian.PutUint64(buffer[9:], a.keepOffset)
+		binary.LittleEndian.PutUint64(buffer[17:], a.records)
+		if _, err = c.w.write(buffer[:]); err != nil {
 			return
 		}
-		n += 9
+		n += len(buffer)
 		// Write string, followed by a zero.
 		//		if n2, err = c.w.WriteString(a.streamName); err != nil {
-		if n2, err = c.w.b.Write([]byte(a.streamName)); err != nil {
+		if n2, err = c.w.write([]byte(a.streamName)); err != nil {
 			return
 		}
 		n += n2
-		if err = c.w.b.WriteByte(0); err != nil {
+		if err = c.w.writeByte(0); err != nil {
 			return
 		}
 
@@ -452,34 +1139,52 @@ func (a *action) write(c *commitLog) (n int, err error) {
 }
 
 func (a *action) recover(c *commitLog) (n int, err error) {
-	if _, ok := c.streams[a.streamName]; ok {
+	if s, ok := c.streams[a.streamName]; ok {
 		// Write flag and stream index
-		n += 3
+		var buffer [binary.MaxVarintLen32]byte
+		n += 1 + putStreamIndex(c.version, buffer[:], s.number)
 	} else {
-		index := uint16(len(c.streams))
-		c.streams[a.streamName] = streamLog{number: index, offset: a.offset, keepOffset: a.offset}
-		n += 9
+		index := uint32(len(c.streams))
+		c.streams[a.streamName] = streamLog{number: index, offset: a.offset, keepOffset: a.keepOffset, records: a.records}
+		n += 1 + nameHeaderSize(c.version)
 		// Write string, followed by a zero.
 		n += len(a.streamName) + 1
 	}
 	return
 }
 
+// nameHeaderSize returns the number of bytes between the flags and the stream name of an action carrying the name.
+func nameHeaderSize(version uint8) int {
+	if version == formatVersion1 {
+		// Offset
+		return 8
+	}
+	// Offset, keepOffset and number of records
+	return 24
+}
+
 func (a *action) read(r *reader) error {
 	// Read flag byte
-	b, err := r.b.ReadByte()
+	b, err := r.readByte()
 	if err != nil {
 		return err
 	}
 	a.flags = actionFlags(b)
-	var buffer [8]byte
+	var buffer [24]byte
 	if (a.flags & actionWithName) == actionWithName {
-		_, err := io.ReadFull(r.b, buffer[:8])
+		err := r.readFull(buffer[:nameHeaderSize(r.version)])
 		if err != nil {
 			return err
 		}
 		a.offset = binary.LittleEndian.Uint64(buffer[:8])
-		str, err := r.b.ReadString(0)
+		// Logs of formatVersion1 do not store the keepOffset. No byte has been pollarded there
+		// before the first byte of the stream in the log.
+		a.keepOffset = a.offset
+		if r.version != formatVersion1 {
+			a.keepOffset = binary.LittleEndian.Uint64(buffer[8:16])
+			a.records = binary.LittleEndian.Uint64(buffer[16:24])
+		}
+		str, err := r.readString(0)
 		if err != nil {
 			return err
 		}
@@ -487,12 +1192,11 @@ func (a *action) read(r *reader) error {
 		a.streamName = str[:len(str)-1]
 		r.names = append(r.names, a.streamName)
 	} else {
-		_, err := io.ReadFull(r.b, buffer[:2])
+		index, err := r.readStreamIndex()
 		if err != nil {
 			return err
 		}
-		index := binary.LittleEndian.Uint16(buffer[:2])
-		if index >= uint16(len(r.names)) {
+		if index >= uint32(len(r.names)) {
 			return errors.New("Wrong index")
 		}
 		a.streamName = r.names[index]
@@ -500,39 +1204,99 @@ func (a *action) read(r *reader) error {
 	return nil
 }
 
+// putStreamIndex serializes a stream index to the buffer and returns the number of bytes written.
+func putStreamIndex(version uint8, buffer []byte, index uint32) int {
+	if version == formatVersion1 {
+		binary.LittleEndian.PutUint16(buffer, uint16(index))
+		return 2
+	}
+	return binary.PutUvarint(buffer, uint64(index))
+}
+
+func (r *reader) readStreamIndex() (uint32, error) {
+	if r.version == formatVersion1 {
+		var buffer [2]byte
+		if err := r.readFull(buffer[:]); err != nil {
+			return 0, err
+		}
+		return uint32(binary.LittleEndian.Uint16(buffer[:])), nil
+	}
+	var index uint64
+	for shift := uint(0); ; shift += 7 {
+		b, err := r.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if shift >= 32 {
+			return 0, errors.New("Wrong index")
+		}
+		index |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			break
+		}
+	}
+	if index > 0xffffffff {
+		return 0, errors.New("Wrong index")
+	}
+	return uint32(index), nil
+}
+
 func (a *appendAction) write(c *commitLog) (n int, err error) {
 	// Write information about the stream
 	if n, err = a.a.write(c); err != nil {
 		return
 	}
-	// Write size of data
-	var buffer [8]byte
+	// Write size of data and commit time
+	t := a.time
+	if t == 0 {
+		t = c.commitTime()
+	}
+	var buffer [21]byte
 	binary.LittleEndian.PutUint32(buffer[:4], uint32(len(a.data)))
-	if _, err = c.w.b.Write(buffer[:4]); err != nil {
+	binary.LittleEndian.PutUint64(buffer[4:], uint64(t))
+	// Write the codec, the key and the size of the unencoded data
+	buffer[12] = a.codec
+	binary.LittleEndian.PutUint32(buffer[13:], a.key)
+	l := 17
+	if a.codec != 0 || a.key != 0 {
+		binary.LittleEndian.PutUint32(buffer[l:], uint32(a.size))
+		l += 4
+	}
+	if _, err = c.w.write(buffer[:l]); err != nil {
 		return
 	}
-	n += 4
+	n += l
 	// FAT
 	s := c.streams[a.a.streamName]
+	s.deleted = false
 	if s.length == 0 {
 		// First FAT entry
-		s.firstFatIndex = uint16(len(c.fat))
+		s.firstFatIndex = uint32(len(c.fat))
 		s.lastFatIndex = s.firstFatIndex
 	} else {
 		// Append to FAT entry
-		l := uint16(len(c.fat))
+		l := uint32(len(c.fat))
 		c.fat[s.lastFatIndex].next = l
 		s.lastFatIndex = l
 	}
-	s.length += len(a.data)
-	c.streams[a.a.streamName] = s
 	var f fatEntry
-	f.length = len(a.data)
+	f.length = a.length()
 	f.next = 0
 	f.pos = c.size + n
+	f.offset = s.offset + uint64(s.length)
+	f.time = t
+	f.codec = a.codec
+	f.key = a.key
+	f.stored = len(a.data)
+	s.index = append(s.index, uint32(len(c.fat)))
+	s.length += f.length
+	if a.a.flags&endOfRecord != 0 {
+		s.recordEnds = append(s.recordEnds, s.offset+uint64(s.length))
+	}
+	c.streams[a.a.streamName] = s
 	c.fat = append(c.fat, f)
 	// Write data
-	if _, err = c.w.b.Write(a.data); err != nil {
+	if _, err = c.w.write(a.data); err != nil {
 		return
 	}
 	n += len(a.data)
@@ -544,26 +1308,47 @@ func (a *appendAction) recover(c *commitLog) (n int, err error) {
 	if n, err = a.a.recover(c); err != nil {
 		return
 	}
-	// Write size of data
+	// Write size of data, commit time, codec and key
 	n += 4
+	if c.version == formatVersion1 {
+		a.time = c.recovered.UnixNano()
+	} else {
+		n += 8 + 1 + 4
+		if a.time > c.lastTime {
+			c.lastTime = a.time
+		}
+		if a.codec != 0 || a.key != 0 {
+			n += 4
+		}
+	}
 	// FAT
 	s := c.streams[a.a.streamName]
+	s.deleted = false
 	if s.length == 0 {
 		// First FAT entry
-		s.firstFatIndex = uint16(len(c.fat))
+		s.firstFatIndex = uint32(len(c.fat))
 		s.lastFatIndex = s.firstFatIndex
 	} else {
 		// Append to FAT entry
-		l := uint16(len(c.fat))
+		l := uint32(len(c.fat))
 		c.fat[s.lastFatIndex].next = l
 		s.lastFatIndex = l
 	}
-	s.length += len(a.data)
-	c.streams[a.a.streamName] = s
 	var f fatEntry
-	f.length = len(a.data)
+	f.length = a.length()
 	f.next = 0
 	f.pos = c.size + n
+	f.offset = s.offset + uint64(s.length)
+	f.time = a.time
+	f.codec = a.codec
+	f.key = a.key
+	f.stored = len(a.data)
+	s.index = append(s.index, uint32(len(c.fat)))
+	s.length += f.length
+	if a.a.flags&endOfRecord != 0 {
+		s.recordEnds = append(s.recordEnds, s.offset+uint64(s.length))
+	}
+	c.streams[a.a.streamName] = s
 	c.fat = append(c.fat, f)
 	// Write data
 	n += len(a.data)
@@ -575,24 +1360,94 @@ func (a *appendAction) read(r *reader) (err error) {
 		return
 	}
 	var buffer [8]byte
-	if _, err = io.ReadFull(r.b, buffer[:4]); err != nil {
+	if err = r.readFull(buffer[:4]); err != nil {
 		return
 	}
 	l := int(binary.LittleEndian.Uint32(buffer[:]))
+	if r.version != formatVersion1 {
+		if err = r.readFull(buffer[:]); err != nil {
+			return
+		}
+		a.time = int64(binary.LittleEndian.Uint64(buffer[:]))
+		if a.codec, err = r.readByte(); err != nil {
+			return
+		}
+		if err = r.readFull(buffer[:4]); err != nil {
+			return
+		}
+		a.key = binary.LittleEndian.Uint32(buffer[:4])
+		if a.codec != 0 || a.key != 0 {
+			if err = r.readFull(buffer[:4]); err != nil {
+				return
+			}
+			a.size = int(binary.LittleEndian.Uint32(buffer[:4]))
+		}
+	}
+	if !r.canRead(l) {
+		return io.ErrUnexpectedEOF
+	}
 	a.data = make([]byte, l)
-	if _, err = io.ReadFull(r.b, a.data); err != nil {
+	if err = r.readFull(a.data); err != nil {
 		return
 	}
 	return
 }
 
+// length returns the number of stream bytes appended by the action.
+func (a *appendAction) length() int {
+	if a.codec != 0 || a.key != 0 {
+		return a.size
+	}
+	return len(a.data)
+}
+
+// compress compresses the data with the codec, unless this does not make it smaller.
+// A nil codec leaves the data uncompressed.
+func (a *appendAction) compress(codec Codec) error {
+	if codec == nil || len(a.data) == 0 {
+		return nil
+	}
+	data, err := codec.Compress(a.data)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(a.data) {
+		a.codec = codec.ID()
+		a.size = len(a.data)
+		a.data = data
+	}
+	return nil
+}
+
+// encrypt encrypts the data with the key the provider chooses for the stream.
+// A nil provider leaves the data unencrypted.
+func (a *appendAction) encrypt(keys KeyProvider) error {
+	if keys == nil || len(a.data) == 0 {
+		return nil
+	}
+	id, err := keys.StreamKey(a.a.streamName)
+	if err != nil || id == 0 {
+		return err
+	}
+	data, err := sealData(keys, id, a.data, payloadAAD(a.a.streamName, a.a.offset))
+	if err != nil {
+		return err
+	}
+	if a.codec == 0 {
+		a.size = len(a.data)
+	}
+	a.key = id
+	a.data = data
+	return nil
+}
+
 func (a *pollardAction) write(c *commitLog) (n int, err error) {
 	if n, err = a.a.write(c); err != nil {
 		return
 	}
 	var buffer [8]byte
 	binary.LittleEndian.PutUint64(buffer[:8], a.pollardPos)
-	if _, err = c.w.b.Write(buffer[:8]); err != nil {
+	if _, err = c.w.write(buffer[:8]); err != nil {
 		return
 	}
 	n += 8
@@ -619,9 +1474,108 @@ func (a *pollardAction) read(r *reader) (err error) {
 		return
 	}
 	var buffer [8]byte
-	if _, err = io.ReadFull(r.b, buffer[:8]); err != nil {
+	if err = r.readFull(buffer[:8]); err != nil {
 		return
 	}
 	a.pollardPos = binary.LittleEndian.Uint64(buffer[:])
 	return
 }
+
+func (a *deleteAction) write(c *commitLog) (n int, err error) {
+	if n, err = a.a.write(c); err != nil {
+		return
+	}
+	c.deleteStream(a.a.streamName)
+	return
+}
+
+func (a *deleteAction) recover(c *commitLog) (n int, err error) {
+	if n, err = a.a.recover(c); err != nil {
+		return
+	}
+	c.deleteStream(a.a.streamName)
+	return
+}
+
+func (a *deleteAction) read(r *reader) error {
+	return a.a.read(r)
+}
+
+// deleteStream forgets all data of the stream. Appending to the stream afterwards starts at offset 0.
+// The stream keeps its number, since later actions refer to it.
+func (c *commitLog) deleteStream(streamName string) {
+	s := c.streams[streamName]
+	c.streams[streamName] = streamLog{number: s.number, deleted: true, fresh: true}
+}
+
+// markFresh tells that older logs hold no data of the stream, because it has been deleted before
+// the data in the log has been written. Compaction uses it to preserve the deletions of the merged logs.
+// It is not recovered, hence the log must be finalized before it is used.
+func (c *commitLog) markFresh(streamName string) {
+	s := c.streams[streamName]
+	s.fresh = true
+	c.streams[streamName] = s
+}
+
+func (a *batchAction) write(c *commitLog) (n int, err error) {
+	var buffer [5]byte
+	buffer[0] = flagBatch
+	binary.LittleEndian.PutUint32(buffer[1:], uint32(len(a.appends)))
+	if _, err = c.w.write(buffer[:]); err != nil {
+		return
+	}
+	n = len(buffer)
+	// The appends compute their positions from the size of the log, which grows only once the batch is complete
+	size := c.size
+	defer func() { c.size = size }()
+	for i := range a.appends {
+		c.size = size + n
+		n2, err := a.appends[i].write(c)
+		if err != nil {
+			return 0, err
+		}
+		n += n2
+	}
+	return n, nil
+}
+
+func (a *batchAction) recover(c *commitLog) (n int, err error) {
+	n = 5
+	size := c.size
+	defer func() { c.size = size }()
+	for i := range a.appends {
+		c.size = size + n
+		n2, err := a.appends[i].recover(c)
+		if err != nil {
+			return 0, err
+		}
+		n += n2
+	}
+	return n, nil
+}
+
+func (a *batchAction) read(r *reader) error {
+	var buffer [5]byte
+	if err := r.readFull(buffer[:]); err != nil {
+		return err
+	}
+	count := binary.LittleEndian.Uint32(buffer[1:])
+	// Each append takes at least 2 bytes
+	if !r.canRead(int(count) * 2) {
+		return io.ErrUnexpectedEOF
+	}
+	a.appends = make([]appendAction, count)
+	for i := range a.appends {
+		flags, err := r.peekAction()
+		if err != nil {
+			return err
+		}
+		if flags&flagMask != flagAppend {
+			return errUnknownAction
+		}
+		if err := a.appends[i].read(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,146 +1,974 @@
 package queue
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
-func TestCommit(t *testing.T) {
-	os.Remove("test.log")
-	c := newCommitLog()
-	if err := c.create("test.log"); err != nil {
-		t.Fatal(err)
-	}
-
-	var a appendAction
-	a.a.flags = flagAppend
-	a.a.streamName = "s1"
-	a.a.offset = 0
-	a.data = []byte("Hello World")
-	if err := c.commit(&a); err != nil {
-		t.Fatal(err)
-	}
+// forEachStorage runs a test against the disk and the memory backend.
+// dir is the directory to store the files of the test in.
+func forEachStorage(t *testing.T, test func(t *testing.T, storage Storage, dir string)) {
+	t.Run("Disk", func(t *testing.T) {
+		test(t, DiskStorage, t.TempDir())
+	})
+	t.Run("Memory", func(t *testing.T) {
+		test(t, NewMemoryStorage(), "test")
+	})
+}
 
-	a.a.streamName = "s1"
-	a.a.offset = 11
-	a.data = []byte("!Great!")
-	if err := c.commit(&a); err != nil {
-		t.Fatal(err)
+// readFile returns the content of a file of the storage.
+func readFile(storage Storage, name string) ([]byte, error) {
+	info, err := storage.Stat(name)
+	if err != nil {
+		return nil, err
 	}
-
-	a.a.flags = flagAppend
-	a.a.streamName = "a1"
-	a.a.offset = 0
-	a.data = []byte("This is A")
-	if err := c.commit(&a); err != nil {
-		t.Fatal(err)
+	f, err := storage.Open(name)
+	if err != nil {
+		return nil, err
 	}
-
-	a.a.flags = flagAppend
-	a.a.streamName = "b1"
-	a.a.offset = 0
-	a.data = []byte("This is B")
-	if err := c.commit(&a); err != nil {
-		t.Fatal(err)
+	defer f.Close()
+	data := make([]byte, info.Size())
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return nil, err
 	}
+	return data, nil
+}
 
-	span, err := c.streamRange("s1")
+// writeFile replaces the content of a file of the storage.
+func writeFile(storage Storage, name string, data []byte) error {
+	f, err := storage.Create(name)
 	if err != nil {
-		t.Fatal(err)
+		return err
 	}
-	if span.From != 0 || span.To != 18 {
-		t.Fatal("streamRange")
+	if _, err := f.WriteAt(data, 0); err != nil {
+		f.Close()
+		return err
 	}
+	return f.Close()
+}
 
-	var data2 [18]byte
-	n, err := c.readStream("s1", 0, data2[:])
-	if err != nil || len(data2) != n {
-		t.Fatal(n, err)
-	}
-	if string(data2[:]) != "Hello World!Great!" {
-		t.Fatal(string(data2[:]), "Wrong text")
-	}
+func TestCommit(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		fileName := filepath.Join(dir, "test.log")
+		c := newCommitLog(storage)
+		if err := c.create(fileName); err != nil {
+			t.Fatal(err)
+		}
 
-	var data3 [11]byte
-	n, err = c.readStream("s1", 6, data3[:])
-	if err != nil || len(data3) != n {
-		t.Fatal(n, err)
-	}
-	if string(data3[:]) != "World!Great" {
-		t.Fatal(string(data3[:]), "Wrong text")
-	}
+		var a appendAction
+		a.a.flags = flagAppend
+		a.a.streamName = "s1"
+		a.a.offset = 0
+		a.data = []byte("Hello World")
+		if err := c.commit(&a); err != nil {
+			t.Fatal(err)
+		}
 
-	var p pollardAction
-	p.a.flags = flagPollard
-	p.a.streamName = "s1"
-	p.a.offset = span.To
-	p.pollardPos = 6
-	if err := c.commit(&p); err != nil {
-		t.Fatal(err)
-	}
+		a.a.streamName = "s1"
+		a.a.offset = 11
+		a.data = []byte("!Great!")
+		if err := c.commit(&a); err != nil {
+			t.Fatal(err)
+		}
 
-	span, err = c.streamRange("s1")
-	if err != nil {
-		t.Fatal(err)
-	}
-	if span.From != 6 || span.To != 18 {
-		t.Fatal("streamRange")
-	}
+		a.a.flags = flagAppend
+		a.a.streamName = "a1"
+		a.a.offset = 0
+		a.data = []byte("This is A")
+		if err := c.commit(&a); err != nil {
+			t.Fatal(err)
+		}
 
-	var data [12]byte
-	n, err = c.readStream("s1", 6, data[:])
-	if err != nil || len(data) != n {
-		t.Fatal(n, err)
-	}
-	if string(data[:]) != "World!Great!" {
-		t.Fatal(string(data[:]), "Wrong text")
-	}
+		a.a.flags = flagAppend
+		a.a.streamName = "b1"
+		a.a.offset = 0
+		a.data = []byte("This is B")
+		if err := c.commit(&a); err != nil {
+			t.Fatal(err)
+		}
 
-	if err = c.close(); err != nil {
-		t.Fatal(err)
-	}
+		span, err := c.streamRange("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if span.From != 0 || span.To != 18 {
+			t.Fatal("streamRange")
+		}
 
-	c2 := newCommitLog()
-	if err = c2.recover("test.log"); err != nil {
-		t.Fatal(err)
-	}
+		var data2 [18]byte
+		n, err := c.readStream("s1", 0, data2[:])
+		if err != nil || len(data2) != n {
+			t.Fatal(n, err)
+		}
+		if string(data2[:]) != "Hello World!Great!" {
+			t.Fatal(string(data2[:]), "Wrong text")
+		}
+
+		var data3 [11]byte
+		n, err = c.readStream("s1", 6, data3[:])
+		if err != nil || len(data3) != n {
+			t.Fatal(n, err)
+		}
+		if string(data3[:]) != "World!Great" {
+			t.Fatal(string(data3[:]), "Wrong text")
+		}
+
+		var p pollardAction
+		p.a.flags = flagPollard
+		p.a.streamName = "s1"
+		p.a.offset = span.To
+		p.pollardPos = 6
+		if err := c.commit(&p); err != nil {
+			t.Fatal(err)
+		}
+
+		span, err = c.streamRange("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if span.From != 6 || span.To != 18 {
+			t.Fatal("streamRange")
+		}
+
+		var data [12]byte
+		n, err = c.readStream("s1", 6, data[:])
+		if err != nil || len(data) != n {
+			t.Fatal(n, err)
+		}
+		if string(data[:]) != "World!Great!" {
+			t.Fatal(string(data[:]), "Wrong text")
+		}
+
+		if err = c.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		c2 := newCommitLog(storage)
+		if err = c2.recover(fileName); err != nil {
+			t.Fatal(err)
+		}
+
+		span, err = c2.streamRange("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if span.From != 6 || span.To != 18 {
+			t.Fatal("streamRange")
+		}
+
+		n, err = c2.readStream("s1", 6, data[:])
+		if err != nil || len(data) != n {
+			t.Fatal(n, err)
+		}
+		if string(data[:]) != "World!Great!" {
+			t.Fatal(string(data[:]), "Wrong text")
+		}
+
+		if err = c2.finalize(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := newLogReader(storage, fileName)
+		if err := r.open(); err != nil {
+			t.Fatal(err)
+		}
+		e, err := r.search("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.span.From != 6 || e.span.To != 18 {
+			t.Fatal("Wrong range")
+		}
+		var data4 [6]byte
+		if err = r.read(e, 7, data4[:]); err != nil {
+			t.Fatal(err)
+		}
+		if string(data4[:]) != "orld!G" {
+			t.Fatal("Wrong data", string(data4[:]))
+		}
+	})
+}
+
+func TestCommitChecksum(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		fileName := filepath.Join(dir, "test_crc.log")
+		c := newCommitLog(storage)
+		if err := c.create(fileName); err != nil {
+			t.Fatal(err)
+		}
+
+		var a appendAction
+		a.a.flags = flagAppend
+		a.a.streamName = "s1"
+		a.a.offset = 0
+		a.data = []byte("Hello World")
+		if err := c.commit(&a); err != nil {
+			t.Fatal(err)
+		}
+		good := c.size
+
+		a.a.offset = 11
+		a.data = []byte("!Great!")
+		if err := c.commit(&a); err != nil {
+			t.Fatal(err)
+		}
+		size := c.size
+		if err := c.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Flip a bit in the payload of the second action
+		f, err := storage.OpenWrite(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b [1]byte
+		if _, err := f.ReadAt(b[:], int64(size-checksumSize-2)); err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0x10
+		if _, err := f.WriteAt(b[:], int64(size-checksumSize-2)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		c2 := newCommitLog(storage)
+		if err = c2.recover(fileName); err != nil {
+			t.Fatal(err)
+		}
+		if c2.size != good || c2.dropped != int64(size-good) || c2.dropReason != errChecksum {
+			t.Fatal(c2.size, c2.dropped, c2.dropReason)
+		}
+		span, err := c2.streamRange("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if span.From != 0 || span.To != 11 {
+			t.Fatal("streamRange", span)
+		}
+
+		// Appending after recovery continues behind the last good action
+		a.data = []byte("?Fine?")
+		if err := c2.commit(&a); err != nil {
+			t.Fatal(err)
+		}
+		if err = c2.finalize(); err != nil {
+			t.Fatal(err)
+		}
 
-	span, err = c2.streamRange("s1")
+		r := newLogReader(storage, fileName)
+		if err := r.open(); err != nil {
+			t.Fatal(err)
+		}
+		if pos, err := r.verify(); err != nil {
+			t.Fatal(pos, err)
+		}
+		e, err := r.search("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data [17]byte
+		if err = r.read(e, 0, data[:]); err != nil {
+			t.Fatal(err)
+		}
+		if string(data[:]) != "Hello World?Fine?" {
+			t.Fatal("Wrong data", string(data[:]))
+		}
+		r.close()
+
+		// Corrupt the first action of the finalized log
+		f, err = storage.OpenWrite(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte("J"), int64(good-checksumSize-11)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if err := r.open(); err != nil {
+			t.Fatal(err)
+		}
+		if pos, err := r.verify(); err != errChecksum || pos != headerSize {
+			t.Fatal(pos, err)
+		}
+		r.close()
+	})
+}
+
+func TestCommitManyStreams(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		fileName := filepath.Join(dir, "test.log")
+		c := newCommitLog(storage)
+		if err := c.create(fileName); err != nil {
+			t.Fatal(err)
+		}
+		// More streams and appends than 16 bit indices can address
+		const count = 70000
+		var a appendAction
+		a.a.flags = flagAppend
+		for i := 0; i < count; i++ {
+			a.a.streamName = fmt.Sprintf("s%05d", i)
+			a.data = []byte{byte(i)}
+			if err := c.append(&a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		a.a.streamName = "s00000"
+		a.a.offset = 1
+		a.data = []byte("last")
+		if err := c.commit(&a); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		c2 := newCommitLog(storage)
+		if err := c2.recover(fileName); err != nil {
+			t.Fatal(err)
+		}
+		if len(c2.streams) != count || len(c2.fat) != count+1 || c2.version != formatVersion {
+			t.Fatal(len(c2.streams), len(c2.fat), c2.version)
+		}
+		var data [5]byte
+		if n, err := c2.readStream("s00000", 0, data[:]); err != nil || n != 5 || string(data[1:]) != "last" {
+			t.Fatal(n, err, data)
+		}
+		if err := c2.finalize(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := newLogReader(storage, fileName)
+		if err := r.open(); err != nil {
+			t.Fatal(err)
+		}
+		defer r.close()
+		if pos, err := r.verify(); err != nil {
+			t.Fatal(pos, err)
+		}
+		e, err := r.search(fmt.Sprintf("s%05d", count-1))
+		if err != nil || e.span.From != 0 || e.span.To != 1 {
+			t.Fatal(e.span, err)
+		}
+		if err := r.read(e, 0, data[:1]); err != nil || data[0] != byte((count-1)%256) {
+			t.Fatal(data, err)
+		}
+	})
+}
+
+func TestCommitOffsetIndex(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		fileName := filepath.Join(dir, "test.log")
+		c := newCommitLog(storage)
+		if err := c.create(fileName); err != nil {
+			t.Fatal(err)
+		}
+		// Appends of varying size, interleaved with appends to another stream
+		var all []byte
+		var a appendAction
+		a.a.flags = flagAppend
+		for i := 0; i < 1000; i++ {
+			a.a.streamName = "s1"
+			a.a.offset = uint64(len(all))
+			a.data = make([]byte, i%7)
+			for j := range a.data {
+				a.data[j] = byte(len(all) + j)
+			}
+			all = append(all, a.data...)
+			if err := c.append(&a); err != nil {
+				t.Fatal(err)
+			}
+			a.a.streamName = "s2"
+			a.a.offset = uint64(i)
+			a.data = []byte{byte(i)}
+			if err := c.append(&a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Pollard in the middle of an append
+		var p pollardAction
+		p.a.flags = flagPollard
+		p.a.streamName = "s1"
+		p.a.offset = uint64(len(all))
+		p.pollardPos = 1001
+		if err := c.commit(&p); err != nil {
+			t.Fatal(err)
+		}
+
+		check := func(read func(offset uint64, data []byte) error) {
+			for from := 1001; from < len(all); from += 97 {
+				for _, size := range []int{1, 5, 13, 200} {
+					if from+size > len(all) {
+						size = len(all) - from
+					}
+					data := make([]byte, size)
+					if err := read(uint64(from), data); err != nil {
+						t.Fatal(from, size, err)
+					}
+					if string(data) != string(all[from:from+size]) {
+						t.Fatal("Wrong data", from, size)
+					}
+				}
+			}
+		}
+		check(func(offset uint64, data []byte) error {
+			_, err := c.readStream("s1", offset, data)
+			return err
+		})
+		if err := c.finalize(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := newLogReader(storage, fileName)
+		if err := r.open(); err != nil {
+			t.Fatal(err)
+		}
+		defer r.close()
+		e, err := r.search("s1")
+		if err != nil || e.span.From != 1001 || e.span.To != uint64(len(all)) {
+			t.Fatal(e.span, err)
+		}
+		if p := e.piece(0); p.offset != 1001 {
+			t.Fatal(p)
+		}
+		check(func(offset uint64, data []byte) error {
+			return r.read(e, offset, data)
+		})
+	})
+}
+
+func TestCommitFilter(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		fileName := filepath.Join(dir, "test.log")
+		c := newCommitLog(storage)
+		if err := c.create(fileName); err != nil {
+			t.Fatal(err)
+		}
+		var a appendAction
+		a.a.flags = flagAppend
+		for i := 0; i < 1000; i++ {
+			a.a.streamName = fmt.Sprintf("s%04d", 2*i)
+			a.data = []byte{byte(i)}
+			if err := c.append(&a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.finalize(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := newLogReader(storage, fileName)
+		falsePositives := 0
+		for i := 0; i < 2000; i++ {
+			ok, err := r.mayContain(fmt.Sprintf("s%04d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i%2 == 0 && !ok {
+				t.Fatal("Stream not found", i)
+			} else if i%2 == 1 && ok {
+				falsePositives++
+			}
+		}
+		if falsePositives > 50 {
+			t.Fatal("Too many false positives", falsePositives)
+		}
+		// Names outside of the range of stored names are rejected
+		for _, n := range []string{"a", "s", "s2000", "t"} {
+			if ok, err := r.mayContain(n); ok || err != nil {
+				t.Fatal(n, err)
+			}
+		}
+		// The filter has been loaded without opening the reader
+		if r.f != nil || r.dict != nil {
+			t.Fatal("The reader has been opened")
+		}
+		if err := r.open(); err != nil {
+			t.Fatal(err)
+		}
+		defer r.close()
+		if pos, err := r.verify(); err != nil {
+			t.Fatal(pos, err)
+		}
+		e, err := r.search("s1998")
+		if err != nil || e.span.To != 1 {
+			t.Fatal(e.span, err)
+		}
+	})
+}
+
+// loadFixture copies a file of the testdata directory to the storage.
+func loadFixture(t *testing.T, storage Storage, fixture string, name string) {
+	data, err := os.ReadFile(filepath.Join("testdata", fixture))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if span.From != 6 || span.To != 18 {
-		t.Fatal("streamRange")
+	if err := writeFile(storage, name, data); err != nil {
+		t.Fatal(err)
 	}
+}
 
-	n, err = c2.readStream("s1", 6, data[:])
-	if err != nil || len(data) != n {
-		t.Fatal(n, err)
+// checkFormatVersion1 checks the content of a finalized log holding the actions of the baseline fixtures.
+func checkFormatVersion1(t *testing.T, storage Storage, fileName string) {
+	r := newLogReader(storage, fileName)
+	if err := r.open(); err != nil {
+		t.Fatal(err)
 	}
-	if string(data[:]) != "World!Great!" {
-		t.Fatal(string(data[:]), "Wrong text")
+	defer r.close()
+	if r.version != formatVersion1 {
+		t.Fatal(r.version)
 	}
-
-	if err = c2.finalize(); err != nil {
-		t.Fatal(err)
+	if pos, err := r.verify(); err != nil {
+		t.Fatal(pos, err)
 	}
-
-	r := newLogReader("test.log")
-	if err := r.open(); err != nil {
+	if _, err := r.checkDict(); err != nil {
 		t.Fatal(err)
 	}
 	e, err := r.search("s1")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if e.span.From != 6 || e.span.To != 18 {
-		t.Fatal("Wrong range")
+	if e.keep != 6 || e.span.From != 6 || e.span.To != 18 {
+		t.Fatal(e.keep, e.span)
 	}
-	var data4 [6]byte
-	if err = r.read(e, 7, data4[:]); err != nil {
+	var data [18]byte
+	if err := r.read(e, 6, data[:12]); err != nil || string(data[:12]) != "World!Great!" {
+		t.Fatal(string(data[:12]), err)
+	}
+	if e, err = r.search("s2"); err != nil {
 		t.Fatal(err)
 	}
-	if string(data4[:]) != "orld!G" {
-		t.Fatal("Wrong data", string(data4[:]))
+	if e.keep != 0 || e.span.From != 0 || e.span.To != 18 {
+		t.Fatal(e.keep, e.span)
+	}
+	if err := r.read(e, 0, data[:]); err != nil || string(data[:]) != "This is B and more" {
+		t.Fatal(string(data[:]), err)
+	}
+	if _, err := r.search("s3"); err != os.ErrNotExist {
+		t.Fatal(err)
 	}
 }
+
+func TestCommitFormatVersion1(t *testing.T) {
+	// The fixtures have been written by the first version of byos.
+	// They hold the same actions, but only the second one has been finalized.
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		fileName := filepath.Join(dir, "active.log")
+		loadFixture(t, storage, "baseline_active.log", fileName)
+		c := newCommitLog(storage)
+		if err := c.recover(fileName); err != nil {
+			t.Fatal(err)
+		}
+		if c.version != formatVersion1 || c.size != 93 || c.dropped != 0 {
+			t.Fatal(c.version, c.size, c.dropped, c.dropReason)
+		}
+		if span, err := c.streamRange("s1"); err != nil || span.From != 6 || span.To != 18 {
+			t.Fatal(span, err)
+		}
+		var data [18]byte
+		if n, err := c.readStream("s1", 6, data[:12]); err != nil || string(data[:n]) != "World!Great!" {
+			t.Fatal(n, err, string(data[:n]))
+		}
+		if n, err := c.readStream("s2", 0, data[:]); err != nil || string(data[:n]) != "This is B and more" {
+			t.Fatal(n, err, string(data[:n]))
+		}
+		// The log is finalized instead of being appended to
+		var a appendAction
+		a.a.flags = flagAppend
+		a.a.streamName = "s1"
+		a.a.offset = 18
+		a.data = []byte("More")
+		if err := c.commit(&a); err != errUnsupportedFormat {
+			t.Fatal(err)
+		}
+		if err := c.finalize(); err != nil {
+			t.Fatal(err)
+		}
+		checkFormatVersion1(t, storage, fileName)
+
+		fileName = filepath.Join(dir, "finalized.log")
+		loadFixture(t, storage, "baseline_finalized.log", fileName)
+		c = newCommitLog(storage)
+		if err := c.recover(fileName); err != errIsFinalized {
+			t.Fatal(err)
+		}
+		if c.version != formatVersion1 || c.dropped != 0 {
+			t.Fatal(c.version, c.dropped, c.dropReason)
+		}
+		checkFormatVersion1(t, storage, fileName)
+		// Both logs have the same content
+		finalized, err := readFile(storage, fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refinalized, err := readFile(storage, filepath.Join(dir, "active.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(finalized) != string(refinalized) {
+			t.Fatal("Finalizing differs from the first version")
+		}
+	})
+}
+
+func TestCommitHeader(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		fileName := filepath.Join(dir, "test.log")
+		c := newCommitLog(storage)
+		c.id = 7
+		if err := c.create(fileName); err != nil {
+			t.Fatal(err)
+		}
+		created := c.created
+		if err := c.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		c2 := newCommitLog(storage)
+		if err := c2.recover(fileName); err != nil {
+			t.Fatal(err)
+		}
+		if c2.id != 7 || c2.version != formatVersion || !c2.created.Equal(created) || c2.size != headerSize {
+			t.Fatal(c2.id, c2.version, c2.created, c2.size)
+		}
+		var a appendAction
+		a.a.flags = flagAppend
+		a.a.streamName = "s1"
+		a.data = []byte("Hello")
+		if err := c2.commit(&a); err != nil {
+			t.Fatal(err)
+		}
+		if err := c2.finalize(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := newLogReader(storage, fileName)
+		if err := r.open(); err != nil {
+			t.Fatal(err)
+		}
+		if r.header.id != 7 || r.version != formatVersion || !r.header.created.Equal(created) {
+			t.Fatal(r.header)
+		}
+		if pos, err := r.verify(); err != nil {
+			t.Fatal(pos, err)
+		}
+		r.close()
+
+		// A corrupted header is detected
+		f, err := storage.OpenWrite(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte{42}, 10); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if err := r.open(); err != errChecksum {
+			t.Fatal(err)
+		}
+		if err := newCommitLog(storage).recover(fileName); err != errChecksum {
+			t.Fatal(err)
+		}
+
+		// A log with an incomplete header is recovered as an empty log
+		f, err = storage.OpenWrite(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Truncate(10); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		c3 := newCommitLog(storage)
+		c3.id = 9
+		if err := c3.recover(fileName); err != nil {
+			t.Fatal(err)
+		}
+		if c3.id != 9 || c3.size != headerSize || c3.dropped != 10 {
+			t.Fatal(c3.id, c3.size, c3.dropped)
+		}
+		c3.close()
+	})
+}
+
+func TestCommitTime(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		fileName := filepath.Join(dir, "test.log")
+		c := newCommitLog(storage)
+		if err := c.create(fileName); err != nil {
+			t.Fatal(err)
+		}
+		var a appendAction
+		a.a.flags = flagAppend
+		a.a.streamName = "s1"
+		for i := 0; i < 100; i++ {
+			a.a.offset = uint64(i)
+			a.data = []byte{byte(i)}
+			if err := c.append(&a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Commit times are strictly increasing, even if the clock is too coarse
+		for i := 1; i < len(c.fat); i++ {
+			if c.fat[i].time <= c.fat[i-1].time {
+				t.Fatal("Commit time is not increasing", i)
+			}
+		}
+		times := make([]int64, len(c.fat))
+		for i := range c.fat {
+			times[i] = c.fat[i].time
+		}
+		if err := c.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Commit times are recovered
+		c2 := newCommitLog(storage)
+		if err := c2.recover(fileName); err != nil {
+			t.Fatal(err)
+		}
+		for i := range c2.fat {
+			if c2.fat[i].time != times[i] {
+				t.Fatal("Wrong commit time", i)
+			}
+		}
+		if c2.commitTime() <= times[len(times)-1] {
+			t.Fatal("Commit time is not increasing")
+		}
+		// Pollard in the middle of the stream
+		var p pollardAction
+		p.a.flags = flagPollard
+		p.a.streamName = "s1"
+		p.a.offset = 100
+		p.pollardPos = 10
+		if err := c2.commit(&p); err != nil {
+			t.Fatal(err)
+		}
+		if err := c2.finalize(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The dict stores the commit times
+		r := newLogReader(storage, fileName)
+		if err := r.open(); err != nil {
+			t.Fatal(err)
+		}
+		defer r.close()
+		e, err := r.search("s1")
+		if err != nil || e.pieceCount() != 90 {
+			t.Fatal(e.pieceCount(), err)
+		}
+		for i := 0; i < e.pieceCount(); i++ {
+			if e.pieceTime(i) != times[i+10] {
+				t.Fatal("Wrong commit time", i)
+			}
+		}
+		if offset, expired := e.expiry(time.Unix(0, times[50])); offset != 50 || !expired {
+			t.Fatal(offset, expired)
+		}
+		if offset, expired := e.expiry(time.Unix(0, times[0])); offset != 10 || expired {
+			t.Fatal(offset, expired)
+		}
+		if tm, end, ok := e.timeAt(42); tm != times[42] || end != 43 || !ok {
+			t.Fatal(tm, end, ok)
+		}
+	})
+}
+
+func TestCommitRecoverFinalize(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		fileName := filepath.Join(dir, "test.log")
+		c := newCommitLog(storage)
+		if err := c.create(fileName); err != nil {
+			t.Fatal(err)
+		}
+		var a appendAction
+		a.a.flags = flagAppend
+		for i := 0; i < 20; i++ {
+			a.a.streamName = fmt.Sprintf("s%d", i%4)
+			a.a.offset = uint64(i / 4 * 5)
+			a.data = []byte(fmt.Sprintf("<%03d>", i))
+			if err := c.append(&a); err != nil {
+				t.Fatal(err)
+			}
+		}
+		actions := int64(c.size)
+		if err := c.finalize(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := readFile(storage, fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A complete dict is kept
+		c2 := newCommitLog(storage)
+		if err := c2.recover(fileName); err != errIsFinalized {
+			t.Fatal(err)
+		}
+		if info, err := storage.Stat(fileName); err != nil || info.Size() != int64(len(data)) {
+			t.Fatal(err)
+		}
+
+		// Finalizing has been interrupted at various positions
+		for _, size := range []int64{actions + 1, actions + 20, int64(len(data)) - 17, int64(len(data)) - 1} {
+			if err := writeFile(storage, fileName, data[:size]); err != nil {
+				t.Fatal(err)
+			}
+			c2 := newCommitLog(storage)
+			if err := c2.recover(fileName); err != errIsFinalized {
+				t.Fatal(size, err)
+			}
+			if c2.dropped != size-actions || c2.dropReason != errIncompleteDict {
+				t.Fatal(size, c2.dropped, c2.dropReason)
+			}
+			r := newLogReader(storage, fileName)
+			if err := r.open(); err != nil {
+				t.Fatal(size, err)
+			}
+			for i := 0; i < 4; i++ {
+				e, err := r.search(fmt.Sprintf("s%d", i))
+				if err != nil || e.span.To != 25 {
+					t.Fatal(size, i, e.span, err)
+				}
+				var buf [5]byte
+				if err := r.read(e, 20, buf[:]); err != nil || string(buf[:]) != fmt.Sprintf("<%03d>", 16+i) {
+					t.Fatal(size, i, err, string(buf[:]))
+				}
+			}
+			r.close()
+		}
+
+		// A corrupt dict is rebuilt as well
+		corrupt := append([]byte{}, data...)
+		corrupt[actions+10] ^= 0xff
+		if err := writeFile(storage, fileName, corrupt); err != nil {
+			t.Fatal(err)
+		}
+		c2 = newCommitLog(storage)
+		if err := c2.recover(fileName); err != errIsFinalized || c2.dropReason != errIncompleteDict {
+			t.Fatal(err, c2.dropReason)
+		}
+		r := newLogReader(storage, fileName)
+		if err := r.open(); err != nil {
+			t.Fatal(err)
+		}
+		r.close()
+	})
+}
+
+func TestCommitBatch(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		fileName := filepath.Join(dir, "test.log")
+		c := newCommitLog(storage)
+		if err := c.create(fileName); err != nil {
+			t.Fatal(err)
+		}
+		var a appendAction
+		a.a.flags = flagAppend
+		a.a.streamName = "s1"
+		a.a.offset = 0
+		a.data = []byte("Hello")
+		if err := c.commit(&a); err != nil {
+			t.Fatal(err)
+		}
+		good := c.size
+
+		// The batch appends to s1 twice and creates s2
+		var b batchAction
+		b.appends = make([]appendAction, 3)
+		b.appends[0].a.flags = flagAppend | endOfRecord
+		b.appends[0].a.streamName = "s1"
+		b.appends[0].a.offset = 5
+		b.appends[0].data = []byte(" World")
+		b.appends[1].a.flags = flagAppend
+		b.appends[1].a.streamName = "s2"
+		b.appends[1].a.offset = 0
+		b.appends[1].data = []byte("New")
+		b.appends[2].a.flags = flagAppend
+		b.appends[2].a.streamName = "s1"
+		b.appends[2].a.offset = 11
+		b.appends[2].data = []byte("!")
+		if err := c.commit(&b); err != nil {
+			t.Fatal(err)
+		}
+		var data [12]byte
+		if n, err := c.readStream("s1", 0, data[:]); err != nil || n != 12 || string(data[:]) != "Hello World!" {
+			t.Fatal(n, err, string(data[:n]))
+		}
+		if err := c.close(); err != nil {
+			t.Fatal(err)
+		}
+		log, err := readFile(storage, fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A batch that has been written partially is dropped as a whole
+		for _, size := range []int{good + 1, good + 5, good + 20, good + 30, len(log) - 1} {
+			if err := writeFile(storage, fileName, log[:size]); err != nil {
+				t.Fatal(err)
+			}
+			c2 := newCommitLog(storage)
+			if err := c2.recover(fileName); err != nil {
+				t.Fatal(size, err)
+			}
+			if c2.size != good || c2.dropped != int64(size-good) || c2.dropReason == nil {
+				t.Fatal(size, c2.size, c2.dropped, c2.dropReason)
+			}
+			if span, err := c2.streamRange("s1"); err != nil || span.To != 5 {
+				t.Fatal(size, span, err)
+			}
+			if _, err := c2.streamRange("s2"); err != os.ErrNotExist {
+				t.Fatal(size, err)
+			}
+			if err := c2.close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// A complete batch is recovered as a whole
+		if err := writeFile(storage, fileName, log); err != nil {
+			t.Fatal(err)
+		}
+		c2 := newCommitLog(storage)
+		if err := c2.recover(fileName); err != nil {
+			t.Fatal(err)
+		}
+		if c2.size != len(log) || c2.dropped != 0 {
+			t.Fatal(c2.size, c2.dropped, c2.dropReason)
+		}
+		if s := c2.streams["s1"]; len(s.recordEnds) != 1 || s.recordEnds[0] != 11 {
+			t.Fatal(s.recordEnds)
+		}
+		if err := c2.finalize(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := newLogReader(storage, fileName)
+		if err := r.open(); err != nil {
+			t.Fatal(err)
+		}
+		if pos, err := r.verify(); err != nil {
+			t.Fatal(pos, err)
+		}
+		e, err := r.search("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = r.read(e, 0, data[:]); err != nil || string(data[:]) != "Hello World!" {
+			t.Fatal(err, string(data[:]))
+		}
+		e, err = r.search("s2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = r.read(e, 0, data[:3]); err != nil || string(data[:3]) != "New" {
+			t.Fatal(err, string(data[:3]))
+		}
+		r.close()
+	})
+}
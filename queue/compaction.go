@@ -0,0 +1,462 @@
+package queue
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weistn/byos/queue/util"
+)
+
+// DefaultCompactionMinLogs is the number of finalized log files required to
+// start a background compaction, unless configured otherwise.
+const DefaultCompactionMinLogs = 4
+
+// maxCompactionSize limits the total size of the log files merged by one compaction,
+// because finalized logs address their content with 32 bit positions.
+// It is a variable, such that tests can lower it.
+var maxCompactionSize int64 = 1 << 31
+
+// Stream bytes are copied in chunks of this size.
+const compactionChunkSize = 1 << 20
+
+var errStreamIncomplete = errors.New("Stream data is missing in the log files")
+
+// The compactor runs compactions in the background.
+type compactor struct {
+	f        *Frontend
+	interval time.Duration
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newCompactor(f *Frontend, interval time.Duration) *compactor {
+	c := &compactor{f: f, interval: interval, done: make(chan struct{})}
+	c.wg.Add(1)
+	go c.run()
+	return c
+}
+
+func (c *compactor) run() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			// Errors are not fatal. The next compaction will try again.
+			c.f.compact(c.f.options.CompactionMinLogs)
+		}
+	}
+}
+
+// stop waits for a running compaction to complete and terminates the compactor.
+func (c *compactor) stop() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+// isCompactionFileName returns true if the name is of the form commit_<number>.log.compact
+func isCompactionFileName(name string) bool {
+	return strings.HasSuffix(name, ".compact") && isLogFileName(name[:len(name)-8])
+}
+
+// Compact merges the oldest finalized log files into one new finalized log file.
+// Log files which are too large to be merged with the following ones are skipped.
+// Pollarded stream bytes are not copied to the new log file.
+// The new log file replaces the merged ones atomically.
+// Append, Read, Stat and Pollard are not blocked while the new log file is written.
+func (f *Frontend) Compact() error {
+	return f.compact(1)
+}
+
+// compact merges the oldest finalized log files if there are at least minLogs of them.
+// The merged log files follow each other, but do not necessarily start with the oldest one.
+func (f *Frontend) compact(minLogs int) error {
+	storage := f.options.Storage
+	f.compactMutex.Lock()
+	defer f.compactMutex.Unlock()
+
+	// Select the oldest finalized log files
+	f.mutex.Lock()
+	if f.log == nil {
+		f.mutex.Unlock()
+		return os.ErrClosed
+	}
+	var files []string
+	var size int64
+	// The modification time of the most recent merged log file
+	var modTime time.Time
+	// True if the merged log files start with the oldest one
+	oldest := true
+	for _, n := range f.logFiles[:len(f.logFiles)-1] {
+		info, err := storage.Stat(n)
+		if err != nil {
+			f.mutex.Unlock()
+			return err
+		}
+		if len(files) > 0 && size+info.Size() > maxCompactionSize {
+			if len(files) > 1 {
+				break
+			}
+			// A log that cannot be merged with the following one is skipped.
+			// Otherwise compaction would rewrite it over and over again.
+			files = nil
+			size = 0
+			oldest = false
+		}
+		files = append(files, n)
+		size += info.Size()
+		modTime = info.ModTime()
+	}
+	f.mutex.Unlock()
+	if len(files) == 0 || len(files) < minLogs {
+		return nil
+	}
+
+	// The finalized log files are immutable. Hence they can be read without holding the mutex.
+	readers := make([]*logReader, len(files))
+	for i, n := range files {
+		readers[i] = newLogReader(storage, n)
+		readers[i].keys = f.options.Keys
+		defer readers[i].close()
+		if err := readers[i].open(); err != nil {
+			return err
+		}
+	}
+
+	// Sorted list of all stream names
+	var names []string
+	known := make(map[string]bool)
+	for _, r := range readers {
+		r.walk(func(streamName string, e logReaderEntry) bool {
+			if !known[streamName] {
+				known[streamName] = true
+				names = append(names, streamName)
+			}
+			return true
+		})
+	}
+	sort.Strings(names)
+
+	// The new log file replaces the most recent of the merged log files
+	target := files[len(files)-1]
+	tmpName := target + ".compact"
+	log := newCommitLog(storage)
+	log.id = uint64(logFileNumber(target))
+	log.first = uint64(logFileNumber(files[0]))
+	log.keys = f.options.Keys
+	log.flags = headerCompacted
+	if err := log.create(tmpName); err != nil {
+		return err
+	}
+	if err := f.compactStreams(log, readers, names, oldest); err != nil {
+		log.close()
+		storage.Remove(tmpName)
+		return err
+	}
+	if err := log.finalize(); err != nil {
+		storage.Remove(tmpName)
+		return err
+	}
+	// Retention tells the age of stream bytes in finalized logs by the modification time of the log file.
+	// Copying the bytes does not make them younger.
+	if err := storage.Chtimes(tmpName, modTime); err != nil {
+		storage.Remove(tmpName)
+		return err
+	}
+
+	// Swap in the new log file
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	index := -1
+	for i, n := range f.logFiles {
+		if n == files[0] {
+			index = i
+			break
+		}
+	}
+	if index < 0 || f.log == nil {
+		storage.Remove(tmpName)
+		return os.ErrClosed
+	}
+	for _, r := range f.logReaders[index : index+len(files)] {
+		f.pool.remove(r)
+	}
+	if err := storage.Rename(tmpName, target); err != nil {
+		storage.Remove(tmpName)
+		return err
+	}
+	if err := storage.SyncDir(f.pathName); err != nil {
+		return err
+	}
+	// If removing fails or is interrupted, the remaining log files are not searched anymore.
+	// They are removed when the store is opened next time, see mergedLogs.
+	for _, n := range files[:len(files)-1] {
+		storage.Remove(n)
+	}
+	logReaders := append([]*logReader{}, f.logReaders[:index]...)
+	logReaders = append(logReaders, f.newLogReader(target))
+	f.logReaders = append(logReaders, f.logReaders[index+len(files):]...)
+	logFiles := append([]string{}, f.logFiles[:index]...)
+	logFiles = append(logFiles, target)
+	f.logFiles = append(logFiles, f.logFiles[index+len(files):]...)
+	return nil
+}
+
+// compactStreams copies all stream bytes which have not been pollarded from the readers to the log.
+// The ends of records are preserved, unless the records have been pollarded completely.
+// Unless the readers start with the oldest log, older logs might hold data of streams deleted in the readers.
+// Hence the deletions are preserved then.
+func (f *Frontend) compactStreams(log *commitLog, readers []*logReader, names []string, oldest bool) error {
+	buf := make([]byte, compactionChunkSize)
+	for _, n := range names {
+		// Determine which bytes and records of the stream are stored in the log files
+		var span util.Span
+		var keep uint64
+		var records uint64
+		// Record ends by record number, starting with number records
+		var ends []uint64
+		found := false
+		deleted := false
+		// True if the stream has been deleted before the bytes found
+		fresh := false
+		for i := len(readers) - 1; i >= 0; i-- {
+			e, err := readers[i].search(n)
+			if err == os.ErrNotExist {
+				continue
+			} else if err == errStreamDeleted {
+				deleted = !found
+				fresh = found
+				break
+			} else if err != nil {
+				return err
+			}
+			if !found {
+				// The most recent log file is authoritative
+				span = e.span
+				keep = e.keep
+				records = e.records
+				for j := 0; j < e.recordCount(); j++ {
+					ends = append(ends, e.recordEnd(j))
+				}
+				found = true
+			} else {
+				if e.span.From < span.From {
+					span.From = e.span.From
+				}
+				if e.records < records && e.records+uint64(e.recordCount()) >= records {
+					// Prepend the record ends that are missing in the newer logs
+					var older []uint64
+					for j := 0; j < int(records-e.records); j++ {
+						older = append(older, e.recordEnd(j))
+					}
+					ends = append(older, ends...)
+					records = e.records
+				}
+			}
+			if e.flags&entryFresh != 0 {
+				// Older logs hold data of the stream before it has been deleted
+				fresh = true
+				break
+			}
+		}
+		if deleted {
+			if oldest {
+				// There is no older data the deletion has to hide
+				continue
+			}
+			var a deleteAction
+			a.a.flags = flagDelete
+			a.a.streamName = n
+			if err := log.append(&a); err != nil {
+				return err
+			}
+			continue
+		}
+		// The stream might have been pollarded in a newer log
+		f.mutex.RLock()
+		_, k, err := f.streamState(n)
+		f.mutex.RUnlock()
+		if err != nil && err != os.ErrNotExist {
+			return err
+		}
+		if k > keep {
+			keep = k
+		}
+		if span.From < keep {
+			span.From = keep
+		}
+		if span.From > span.To {
+			// All bytes have been pollarded. Keep track of the stream size
+			span.From = span.To
+		}
+		// Drop the ends of records that ended before the first byte being copied
+		i := 0
+		for i < len(ends) && ends[i] < span.From {
+			i++
+		}
+		records += uint64(i)
+		ends = ends[i:]
+
+		var a appendAction
+		a.a.streamName = n
+		a.a.keepOffset = keep
+		a.a.records = records
+		written := false
+		for offset := span.From; ; {
+			// Empty records
+			for len(ends) > 0 && ends[0] == offset {
+				a.a.flags = flagAppend | endOfRecord
+				a.a.offset = offset
+				a.data = nil
+				a.codec = 0
+				a.key = 0
+				if err := log.append(&a); err != nil {
+					return err
+				}
+				ends = ends[1:]
+				written = true
+			}
+			if offset >= span.To {
+				break
+			}
+			size := span.To - offset
+			if size > compactionChunkSize {
+				size = compactionChunkSize
+			}
+			// Keep the commit time of the copied bytes
+			t, end, err := commitTimeAt(readers, n, offset)
+			if err != nil {
+				return err
+			}
+			if end-offset < size {
+				size = end - offset
+			}
+			a.time = t
+			a.a.flags = flagAppend
+			if len(ends) > 0 && ends[0] <= offset+size {
+				// Copy up to the end of the record
+				size = ends[0] - offset
+				a.a.flags |= endOfRecord
+				ends = ends[1:]
+			}
+			data := buf[:size]
+			missing, err := readLogs(nil, readers, n, offset, data, util.Span{From: offset, To: offset + size})
+			if err != nil {
+				return err
+			}
+			if !missing.IsEmpty() {
+				return errStreamIncomplete
+			}
+			a.a.offset = offset
+			a.data = data
+			a.codec = 0
+			a.key = 0
+			// The current codec and key apply, which re-encrypts data of rotated keys
+			if err := f.encode(&a); err != nil {
+				return err
+			}
+			if err := log.append(&a); err != nil {
+				return err
+			}
+			offset += size
+			written = true
+		}
+		if !written {
+			// Keep track of the stream size and the number of records
+			a.a.flags = flagAppend
+			a.a.offset = span.To
+			a.data = nil
+			a.codec = 0
+			a.key = 0
+			if err := log.append(&a); err != nil {
+				return err
+			}
+		}
+		if fresh && !oldest {
+			log.markFresh(n)
+		}
+	}
+	return nil
+}
+
+// mergedLogs returns the log files which have been merged by a compaction,
+// but have not been removed because the compaction has been interrupted.
+// A compacted log file replaces the most recent of the merged log files. Its header tells the number of
+// the oldest one. The others must not be searched, since they might hold streams deleted meanwhile.
+// The files are sorted by number and the latest one is never compacted.
+func mergedLogs(storage Storage, files []string) (map[string]bool, error) {
+	merged := make(map[string]bool)
+	for i := len(files) - 2; i > 0; i-- {
+		first, compacted, err := compactedFrom(storage, files[i])
+		if err != nil {
+			return nil, err
+		}
+		if !compacted {
+			continue
+		}
+		for j := i - 1; j >= 0 && uint64(logFileNumber(files[j])) >= first; j-- {
+			merged[files[j]] = true
+		}
+	}
+	return merged, nil
+}
+
+// compactedFrom returns the number of the oldest log file merged into the log file
+// and true if the log file has been written by a compaction.
+func compactedFrom(storage Storage, fileName string) (first uint64, compacted bool, err error) {
+	f, err := storage.Open(fileName)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	var buf [headerSize]byte
+	if _, err := f.ReadAt(buf[:], 0); err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	var h logHeader
+	if err := h.unmarshal(buf[:]); err != nil {
+		// Logs of formatVersion1 have no header and are never written by a compaction
+		return 0, false, nil
+	}
+	return h.first, h.flags&headerCompacted != 0, nil
+}
+
+// commitTimeAt returns the commit time of the stream byte at offset in the merged logs
+// and the offset up to which the following bytes have been committed at the same time.
+// Logs of older formats do not store commit times. For their bytes the modification time of the log file is used,
+// since none of them has been committed later.
+func commitTimeAt(readers []*logReader, streamName string, offset uint64) (t int64, end uint64, err error) {
+	for i := len(readers) - 1; i >= 0; i-- {
+		e, err := readers[i].search(streamName)
+		if err == os.ErrNotExist {
+			continue
+		} else if err == errStreamDeleted {
+			break
+		} else if err != nil {
+			return 0, 0, err
+		}
+		if offset < e.span.From || offset >= e.span.To {
+			if e.flags&entryFresh != 0 {
+				break
+			}
+			continue
+		}
+		if t, end, ok := e.timeAt(offset); ok {
+			return t, end, nil
+		}
+		modTime, err := readers[i].finalizedTime()
+		if err != nil {
+			return 0, 0, err
+		}
+		return modTime.UnixNano(), e.span.To, nil
+	}
+	return 0, 0, errStreamIncomplete
+}
@@ -0,0 +1,118 @@
+package queue
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// A KeyProvider supplies the AES keys which encrypt append payloads and the dicts of finalized logs with AES-GCM.
+// Keys are identified by IDs, which are stored next to the encrypted data. Hence a key is rotated by returning
+// a new ID for new data, while Key keeps returning the old key as long as data encrypted by it is stored.
+// Compaction re-encrypts the merged logs with the current keys.
+// The encrypted data is bound to its place: a payload to its stream and offset, a dict to its log.
+// Hence encrypted data moved elsewhere fails to decrypt.
+// The key is chosen per stream. Returning distinct keys for the streams of different tenants,
+// e.g. based on a prefix of the stream name denoting the bundle, separates their data cryptographically.
+// A KeyProvider must be safe for concurrent use.
+type KeyProvider interface {
+	// StreamKey returns the ID of the key encrypting new appends to the stream, or 0 to store them unencrypted.
+	StreamKey(streamName string) (id uint32, err error)
+	// DictKey returns the ID of the key encrypting the dicts of finalized logs, or 0 to store them unencrypted.
+	DictKey() (id uint32, err error)
+	// Key returns the key with the given ID. Keys of 16, 24 or 32 bytes select AES-128, AES-192 or AES-256.
+	Key(id uint32) ([]byte, error)
+}
+
+var errKeyUnavailable = errors.New("No key provider to decrypt the data")
+
+// newAEAD returns AES-GCM using the key with the given ID.
+func newAEAD(keys KeyProvider, id uint32) (cipher.AEAD, error) {
+	if keys == nil {
+		return nil, errKeyUnavailable
+	}
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Prefixes of the additional data, which keep payloads and dicts apart
+const (
+	aadPayload = 'p'
+	aadDict    = 'd'
+)
+
+// payloadAAD returns the additional data binding an encrypted payload to the stream
+// and the stream offset of its first byte. Stream names contain no zero bytes.
+func payloadAAD(streamName string, offset uint64) []byte {
+	aad := make([]byte, 1+len(streamName)+1+8)
+	aad[0] = aadPayload
+	copy(aad[1:], streamName)
+	binary.LittleEndian.PutUint64(aad[len(aad)-8:], offset)
+	return aad
+}
+
+// dictAAD returns the additional data binding an encrypted dict to the log with the given id.
+func dictAAD(id uint64) []byte {
+	aad := make([]byte, 1+8)
+	aad[0] = aadDict
+	binary.LittleEndian.PutUint64(aad[1:], id)
+	return aad
+}
+
+// sealData encrypts data with the key with the given ID and authenticates aad along with it.
+// The result starts with a random nonce.
+func sealData(keys KeyProvider, id uint32, data []byte, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(keys, id)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, aad), nil
+}
+
+// openData decrypts data encrypted by sealData with the same aad.
+func openData(keys KeyProvider, id uint32, data []byte, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(keys, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errChecksum
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
+
+// decodePayload turns the bytes stored by an append back into its length stream bytes
+// by decrypting and decompressing them. The append wrote the stream bytes starting at offset.
+func decodePayload(keys KeyProvider, key uint32, codec uint8, stored []byte, length int, streamName string, offset uint64) ([]byte, error) {
+	if key != 0 {
+		var err error
+		if stored, err = openData(keys, key, stored, payloadAAD(streamName, offset)); err != nil {
+			return nil, err
+		}
+	}
+	if codec == 0 {
+		if len(stored) != length {
+			return nil, errPayloadSize
+		}
+		return stored, nil
+	}
+	raw := make([]byte, length)
+	if err := decompress(codec, raw, stored); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
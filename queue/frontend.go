@@ -8,12 +8,92 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/weistn/byos/queue/util"
 )
 
+// DefaultMaxLogSize is the size of a commit log after which it is finalized
+// and a new commit log is started, unless configured otherwise.
+const DefaultMaxLogSize = 64 << 20
+
+// maxLogSize is the size at which a commit log is finalized regardless of Options.MaxLogSize.
+// Finalized logs address their content with 32 bit positions. Hence a log must stay below 4GB,
+// including the last action and the dict written after reaching maxLogSize.
+// It is a variable, such that tests can lower it.
+var maxLogSize int64 = 1 << 31
+
+var errMaxLogSize = errors.New("MaxLogSize exceeds 2GB")
+var errAppendTooLarge = errors.New("The appended data exceeds 1GB")
+
+// DefaultFlushInterval is the interval at which appends which have not been
+// committed are synced to disk, unless configured otherwise.
+const DefaultFlushInterval = time.Second
+
+// DefaultFlushSize is the number of bytes written without being committed
+// after which the commit log is synced to disk, unless configured otherwise.
+const DefaultFlushSize = 1 << 20
+
+// Options configure a Frontend.
+type Options struct {
+	// The size in bytes after which the commit log is finalized and a new one is started.
+	// A value of 0 means DefaultMaxLogSize. A negative value disables size based rotation,
+	// except that logs are always finalized at 2GB. Larger values are rejected,
+	// since finalized logs address their content with 32 bit positions.
+	MaxLogSize int64
+	// The age after which the commit log is finalized and a new one is started.
+	// The age is checked whenever the log is written to.
+	// A value of 0 disables age based rotation.
+	MaxLogAge time.Duration
+	// The interval at which finalized log files are compacted in the background.
+	// A value of 0 disables background compaction. Compact can still be called explicitly.
+	CompactionInterval time.Duration
+	// The minimum number of finalized log files required to start a background compaction.
+	// A value of 0 means DefaultCompactionMinLogs.
+	CompactionMinLogs int
+	// Enables group commit. Appends are written to a buffer and concurrent appends
+	// arriving within this latency window are synced to disk together.
+	// Each Append returns once its data is durable.
+	// A value of 0 disables group commit, i.e. each committed append is synced on its own.
+	GroupCommitWindow time.Duration
+	// The interval at which appends that have not been committed are synced to disk.
+	// A value of 0 means DefaultFlushInterval.
+	FlushInterval time.Duration
+	// The number of bytes written without being committed after which the commit log is synced to disk.
+	// A value of 0 means DefaultFlushSize.
+	FlushSize int
+	// The maximum number of finalized log files kept open.
+	// A value of 0 means DefaultMaxOpenLogs. A negative value disables the limit.
+	MaxOpenLogs int
+	// The maximum total size of the dicts of the finalized log files kept open.
+	// A value of 0 means DefaultMaxDictMemory. A negative value disables the limit.
+	MaxDictMemory int64
+	// Maps finalized log files into memory. Reads are served from the mapping
+	// and ReadDirect passes stream data without copying it.
+	// If mapping a file fails, it is read from the file instead. Only files of the DiskStorage can be mapped.
+	MmapLogs bool
+	// The interval at which retention policies are enforced in the background.
+	// A value of 0 means DefaultRetentionInterval. A negative value disables background enforcement.
+	// EnforceRetention can still be called explicitly.
+	RetentionInterval time.Duration
+	// Compresses the payloads of appends to streams without a codec set by SetCodec.
+	// A nil value stores payloads uncompressed. Payloads that do not shrink are always stored uncompressed.
+	// The codec is registered by RegisterCodec, which fails if its ID is used by a codec of another type.
+	Codec Codec
+	// Holds the log files. A nil value means DiskStorage.
+	Storage Storage
+	// Supplies the keys encrypting append payloads and the dicts of finalized logs.
+	// Stream names, offsets and sizes in the actions of the commit log and the filters of finalized logs
+	// are not encrypted. A nil value stores all data unencrypted.
+	// A store holding encrypted data can only be read if the keys are supplied.
+	Keys KeyProvider
+}
+
 // The Frontend is the API of the queueing system.
 // It uses workers to carry out its jobs.
+// A Frontend is safe for concurrent use. Appends to the same stream are serialized,
+// while reads only wait for writers holding the mutex to update in-memory state.
 type Frontend struct {
 	log        *commitLog
 	logReaders []*logReader
@@ -21,231 +101,842 @@ type Frontend struct {
 	// Fully qualified names of all finalized log files. Oldest is first and the commitLog is last.
 	// Those opened are listed in logReaders (in the same order).
 	logFiles []string
+	options  Options
+	// Number of actions written to the commit logs so far.
+	written uint64
+	// Appends that have not been synced to disk, in the order they have been written.
+	pending map[string][]pendingAppend
+	// Protects all fields above.
+	// Reading requires a read lock only. The mutex is never held while syncing to disk,
+	// except when the commit log is finalized.
+	mutex sync.RWMutex
+	// Serializes appends and pollards of the same stream
+	streamLocks      map[string]*streamLock
+	streamLocksMutex sync.Mutex
+	// Keeps the most recently used logReaders open
+	pool *readerPool
+	// Syncs buffered actions to disk
+	syncer *syncer
+	// Subscriptions by stream name and appends to notify them about
+	subscriptions      map[string][]*Subscription
+	notifications      []notification
+	subscriptionsMutex sync.Mutex
+	// Non-nil if compaction is running in the background
+	compactor *compactor
+	// Serializes compactions
+	compactMutex sync.Mutex
+	// Retention policies by stream name prefix and acknowledged offsets by stream name
+	retention      map[string]RetentionPolicy
+	acks           map[string]uint64
+	retentionMutex sync.Mutex
+	// Non-nil if retention policies are enforced in the background
+	retainer *retainer
+	// Codecs by stream name prefix
+	streamCodecs map[string]Codec
+	codecMutex   sync.Mutex
+	// Tells how the latest commit log has been recovered
+	recovery RecoveryReport
+}
+
+// A RecoveryReport tells how the latest commit log has been recovered when the Frontend has been opened.
+type RecoveryReport struct {
+	// The log file that has been recovered, or empty if a new store has been created.
+	File string
+	// The number of bytes dropped from the end of the log file, since they did not hold intact actions.
+	Dropped int64
+	// The reason why the bytes have been dropped, or nil if Dropped is 0.
+	Reason error
 }
 
 // StreamStat contains information about a stored stream.
 type StreamStat struct {
 	Size uint64
+	// The number of stream bytes that have been synced to disk.
+	// All bytes up to this offset survive a crash.
+	DurableSize uint64
+}
+
+// streamLock serializes appends and pollards of a stream.
+type streamLock struct {
+	mutex sync.Mutex
+	// Number of goroutines using the lock
+	refs int
 }
 
+// pendingAppend describes an append that has not been synced to disk yet.
+type pendingAppend struct {
+	seq uint64
+	// The size of the stream before the append
+	from uint64
+}
+
+var errHeadUnavailable = errors.New("Head of data unavailable")
+
 // NewFrontend returns a new frontend and (re-)opens the latest commit log.
 func NewFrontend(pathName string) (f *Frontend, err error) {
-	f = &Frontend{pathName: pathName}
-	dir, err := os.Open(pathName)
-	if err != nil {
-		return nil, err
+	return NewFrontendWithOptions(pathName, Options{})
+}
+
+// NewFrontendWithOptions returns a new frontend configured by options and (re-)opens the latest commit log.
+func NewFrontendWithOptions(pathName string, options Options) (f *Frontend, err error) {
+	if options.MaxLogSize == 0 {
+		options.MaxLogSize = DefaultMaxLogSize
+	} else if options.MaxLogSize > maxLogSize {
+		return nil, errMaxLogSize
+	}
+	if options.CompactionMinLogs == 0 {
+		options.CompactionMinLogs = DefaultCompactionMinLogs
+	}
+	if options.FlushInterval == 0 {
+		options.FlushInterval = DefaultFlushInterval
+	}
+	if options.FlushSize == 0 {
+		options.FlushSize = DefaultFlushSize
+	}
+	if options.MaxOpenLogs == 0 {
+		options.MaxOpenLogs = DefaultMaxOpenLogs
+	}
+	if options.MaxDictMemory == 0 {
+		options.MaxDictMemory = DefaultMaxDictMemory
 	}
-	names, err := dir.Readdirnames(0)
+	if options.RetentionInterval == 0 {
+		options.RetentionInterval = DefaultRetentionInterval
+	}
+	if options.Storage == nil {
+		options.Storage = DiskStorage
+	}
+	if options.Codec != nil {
+		// Payloads can only be read if their codec is registered
+		if err := RegisterCodec(options.Codec); err != nil {
+			return nil, err
+		}
+	}
+	f = &Frontend{pathName: pathName, options: options, pending: make(map[string][]pendingAppend), streamLocks: make(map[string]*streamLock), subscriptions: make(map[string][]*Subscription), retention: make(map[string]RetentionPolicy), acks: make(map[string]uint64), streamCodecs: make(map[string]Codec)}
+	f.pool = newReaderPool(options.MaxOpenLogs, options.MaxDictMemory)
+	names, err := options.Storage.ReadDir(pathName)
 	if err != nil {
 		return nil, err
 	}
-	sort.Strings(names)
 	for _, n := range names {
-		if strings.HasSuffix(n, ".log") && strings.HasPrefix(n, "commit_") {
+		if isLogFileName(n) {
 			f.logFiles = append(f.logFiles, filepath.Join(pathName, n))
+		} else if isCompactionFileName(n) {
+			// Left over by a compaction that did not complete
+			if err := options.Storage.Remove(filepath.Join(pathName, n)); err != nil {
+				return nil, err
+			}
 		}
 	}
+	// Sort by number, since the number of digits can vary
+	sort.Slice(f.logFiles, func(i, j int) bool {
+		return logFileNumber(f.logFiles[i]) < logFileNumber(f.logFiles[j])
+	})
+	// Remove the log files left over by a compaction that did not complete
+	merged, err := mergedLogs(options.Storage, f.logFiles)
+	if err != nil {
+		return nil, err
+	}
+	if len(merged) > 0 {
+		var logFiles []string
+		for _, n := range f.logFiles {
+			if !merged[n] {
+				logFiles = append(logFiles, n)
+			} else if err := options.Storage.Remove(n); err != nil {
+				return nil, err
+			}
+		}
+		if err := options.Storage.SyncDir(pathName); err != nil {
+			return nil, err
+		}
+		f.logFiles = logFiles
+	}
 
 	if len(f.logFiles) == 0 {
 		// Nothing there. Create a first log file
-		f.log = newCommitLog()
-		err := f.log.create(filepath.Join(pathName, "commit_0000.log"))
-		if err != nil {
-			f.log.close()
+		if err := f.createLog(); err != nil {
 			return nil, err
 		}
-		f.logFiles = append(f.logFiles, "commit_0000.log")
 	} else {
 		// Try to recover the latest log file
-		f.log = newCommitLog()
-		err := f.log.recover(f.logFiles[0])
+		f.log = newCommitLog(options.Storage)
+		f.log.keys = f.options.Keys
+		f.log.id = uint64(logFileNumber(f.logFiles[len(f.logFiles)-1]))
+		err := f.log.recover(f.logFiles[len(f.logFiles)-1])
+		f.recovery = RecoveryReport{File: f.logFiles[len(f.logFiles)-1], Dropped: f.log.dropped, Reason: f.log.dropReason}
+		if err == nil && f.log.version != formatVersion {
+			// Do not continue writing an outdated format. Finalize the log and create a new one
+			err = f.log.finalize()
+			if err == nil {
+				err = errIsFinalized
+			}
+		}
 		if err == errIsFinalized {
 			// The latest commit log is already finalized. Create a new one
-			f.log.close()
-			// Create a new log file
-			n := f.logFiles[len(f.logFiles)-1]
-			n = n[7 : len(n)-4]
-			number, err := strconv.Atoi(n)
-			if err != nil {
-				panic("Illegal filename " + n)
-			}
-			if number >= 9999 {
-				panic("TODO: Compaction")
-			}
-			n = "commit_" + fmt.Sprintf("%04d", number+1) + ".log"
-			f.log = newCommitLog()
-			err = f.log.create(n)
-			if err != nil {
-				f.log.close()
-				return nil, err
-			}
-			f.logFiles = append(f.logFiles, n)
-		} else {
-			if err != nil {
-				f.log.close()
+			if err := f.createLog(); err != nil {
 				return nil, err
 			}
+		} else if err != nil {
+			return nil, err
 		}
 	}
 	// Create log reader for all finalized log files (all except the latest one)
 	for _, n := range f.logFiles[:len(f.logFiles)-1] {
-		f.logReaders = append(f.logReaders, newLogReader(n))
+		f.logReaders = append(f.logReaders, f.newLogReader(n))
+	}
+	if options.CompactionInterval > 0 {
+		f.compactor = newCompactor(f, options.CompactionInterval)
+	}
+	if options.RetentionInterval > 0 {
+		f.retainer = newRetainer(f, options.RetentionInterval)
 	}
+	f.syncer = newSyncer(f, options.GroupCommitWindow, options.FlushInterval)
 	return f, nil
 }
 
+// isLogFileName returns true if the name is of the form commit_<number>.log
+func isLogFileName(name string) bool {
+	if !strings.HasSuffix(name, ".log") || !strings.HasPrefix(name, "commit_") {
+		return false
+	}
+	_, err := strconv.Atoi(name[7 : len(name)-4])
+	return err == nil
+}
+
+// logFileNumber returns the number of a log file of the form commit_<number>.log
+func logFileNumber(fileName string) int {
+	n := filepath.Base(fileName)
+	n = n[7 : len(n)-4]
+	number, err := strconv.Atoi(n)
+	if err != nil {
+		panic("Illegal filename " + n)
+	}
+	return number
+}
+
+// logFileName returns the fully qualified name of the log file with the given number.
+func (f *Frontend) logFileName(number int) string {
+	return filepath.Join(f.pathName, "commit_"+fmt.Sprintf("%04d", number)+".log")
+}
+
+// newLogReader returns a logReader for a finalized log file, configured by the options.
+func (f *Frontend) newLogReader(filename string) *logReader {
+	r := newLogReader(f.options.Storage, filename)
+	r.mmap = f.options.MmapLogs
+	r.keys = f.options.Keys
+	return r
+}
+
+// createLog creates a new commit log with a file name following the latest log file.
+func (f *Frontend) createLog() error {
+	number := 0
+	if len(f.logFiles) > 0 {
+		number = logFileNumber(f.logFiles[len(f.logFiles)-1]) + 1
+	}
+	name := f.logFileName(number)
+	log := newCommitLog(f.options.Storage)
+	log.id = uint64(number)
+	log.keys = f.options.Keys
+	if f.log != nil {
+		// Commit times keep increasing across logs
+		log.lastTime = f.log.lastTime
+	}
+	if err := log.create(name); err != nil {
+		return err
+	}
+	f.log = log
+	f.logFiles = append(f.logFiles, name)
+	return nil
+}
+
+// rotate finalizes the commit log if it is full or too old and starts a new one.
+// If finalizing fails, the commit log keeps taking actions and rotating is tried again by the next write.
+// If creating the new commit log fails, the next write tries again.
+func (f *Frontend) rotate() error {
+	if !f.log.finalized {
+		full := (f.options.MaxLogSize > 0 && int64(f.log.size) >= f.options.MaxLogSize) || int64(f.log.size) >= maxLogSize
+		old := f.options.MaxLogAge > 0 && time.Since(f.log.created) >= f.options.MaxLogAge
+		if !full && !old {
+			return nil
+		}
+		f.syncer.fileMutex.Lock()
+		err := f.log.finalize()
+		f.syncer.fileMutex.Unlock()
+		if err != nil {
+			return err
+		}
+		// Finalizing syncs all actions written so far
+		f.syncer.markDurable(f.written, nil)
+		f.pruneDurable()
+		f.logReaders = append(f.logReaders, f.newLogReader(f.logFiles[len(f.logFiles)-1]))
+	}
+	return f.createLog()
+}
+
 // Close destructs the frontend and closes all files in use.
+// Closing a closed frontend has no effect.
 func (f *Frontend) Close() {
+	if f.retainer != nil {
+		f.retainer.stop()
+		f.retainer = nil
+	}
+	if f.compactor != nil {
+		f.compactor.stop()
+		f.compactor = nil
+	}
+	f.syncer.stop()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
 	if f.log == nil {
 		return
 	}
-	f.log.close()
-	f.log = nil
-	for _, r := range f.logReaders {
-		r.close()
+	// Closing the log syncs all actions written so far.
+	// A finalized log has been synced already, but creating its successor failed.
+	var err error
+	if !f.log.finalized {
+		f.syncer.fileMutex.Lock()
+		err = f.log.close()
+		f.syncer.fileMutex.Unlock()
 	}
+	f.syncer.close(f.written, err)
+	f.closeSubscriptions()
+	f.log = nil
+	f.pool.close()
 }
 
-// Stat returns information about a stored stream or an error
-// if the stream is unknown.
-func (f *Frontend) Stat(streamName string) (s StreamStat, err error) {
+// streamState returns the size of a stream and the offset of its first byte that has not been pollarded.
+// The most recent log that knows about the stream is authoritative.
+// The caller must hold the mutex, at least for reading.
+func (f *Frontend) streamState(streamName string) (size uint64, keep uint64, err error) {
+	if f.log == nil {
+		return 0, 0, os.ErrClosed
+	}
 	// Search in the commit log first
-	logIndex := len(f.logReaders)
 	span, err := f.log.streamRange(streamName)
-	s.Size = span.To
-	if err == nil || err == os.ErrNotExist {
-		return s, err
+	if err == nil {
+		keep, err = f.log.streamKeepOffset(streamName)
+		return span.To, keep, err
+	} else if err == errStreamDeleted {
+		return 0, 0, os.ErrNotExist
+	} else if err != os.ErrNotExist {
+		return 0, 0, err
 	}
 	// Search in all log readers, starting with the most recent one.
-	for logIndex = logIndex - 1; logIndex >= 0; logIndex-- {
-		r := f.logReaders[logIndex]
-		if !r.isOpen() {
-			if err = r.open(); err != nil {
-				return s, err
-			}
-		}
-		logentry, err := r.search(streamName)
+	for logIndex := len(f.logReaders) - 1; logIndex >= 0; logIndex-- {
+		err = f.pool.search(f.logReaders[logIndex], streamName, func(e logReaderEntry) {
+			size, keep = e.span.To, e.keep
+		})
 		if err == nil {
-			s.Size = logentry.span.To
-			return s, nil
+			return size, keep, nil
+		} else if err == errStreamDeleted {
+			return 0, 0, os.ErrNotExist
 		} else if err != os.ErrNotExist {
-			return s, err
+			return 0, 0, err
 		}
 	}
-	return s, os.ErrNotExist
+	return 0, 0, os.ErrNotExist
+}
+
+// Stat returns information about a stored stream or an error
+// if the stream is unknown.
+func (f *Frontend) Stat(streamName string) (s StreamStat, err error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	s.Size, _, err = f.streamState(streamName)
+	s.DurableSize = s.Size
+	durable := f.syncer.durableSeq()
+	for _, p := range f.pending[streamName] {
+		if p.seq > durable {
+			s.DurableSize = p.from
+			break
+		}
+	}
+	return s, err
+}
+
+// Recovery tells how the latest commit log has been recovered when the Frontend has been opened.
+// Bytes that did not hold intact actions, e.g. because the process crashed while writing them, have been dropped.
+func (f *Frontend) Recovery() RecoveryReport {
+	return f.recovery
+}
+
+// OffsetForTime returns the offset of the first stream byte that has been committed at or after t.
+// Readers can start reading there to receive all data committed since t.
+// If all stream bytes have been committed before t, it returns the size of the stream.
+// The result is never smaller than the offset of the first byte that has not been pollarded.
+// Logs written by older versions do not store commit times. For their bytes the result might be smaller than necessary.
+func (f *Frontend) OffsetForTime(streamName string, t time.Time) (uint64, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	size, keep, err := f.streamState(streamName)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := f.offsetForTime(streamName, t)
+	if err != nil {
+		return 0, err
+	}
+	if offset < keep {
+		offset = keep
+	}
+	if offset > size {
+		offset = size
+	}
+	return offset, nil
+}
+
+// prunePending removes all appends of the stream that have been synced to disk
+// and returns those which are still pending.
+// The caller must hold the mutex for writing.
+func (f *Frontend) prunePending(streamName string) []pendingAppend {
+	p, ok := f.pending[streamName]
+	if !ok {
+		return nil
+	}
+	durable := f.syncer.durableSeq()
+	i := 0
+	for i < len(p) && p[i].seq <= durable {
+		i++
+	}
+	if i == len(p) {
+		delete(f.pending, streamName)
+		return nil
+	}
+	p = p[i:]
+	f.pending[streamName] = p
+	return p
+}
+
+// pruneDurable removes the appends of all streams that have been synced to disk.
+// Otherwise streams that are not written to again would keep their pending appends forever.
+// The caller must hold the mutex for writing.
+func (f *Frontend) pruneDurable() {
+	for streamName := range f.pending {
+		f.prunePending(streamName)
+	}
+}
+
+// Sync blocks until all data written so far has been synced to disk.
+func (f *Frontend) Sync() error {
+	f.mutex.RLock()
+	seq := f.written
+	f.mutex.RUnlock()
+	return f.waitDurable(seq)
 }
 
 // Read returns data from a stored stream.
 // If the stream is too short to deliver all desired data, Read returns less data and no error.
 func (f *Frontend) Read(streamName string, offset uint64, data []byte) (n uint64, err error) {
-	dataspan := util.Span{From: offset, To: offset + uint64(len(data))}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.read(streamName, offset, data)
+}
+
+// read implements Read.
+// The caller must hold the mutex, at least for reading.
+func (f *Frontend) read(streamName string, offset uint64, data []byte) (n uint64, err error) {
+	size, keep, err := f.streamState(streamName)
+	if err != nil {
+		return 0, err
+	}
+	if offset >= size {
+		// The desired data does not exist? -> done
+		return 0, nil
+	}
+	if offset < keep {
+		// Some of the first requested bytes have been removed by pollard.
+		return 0, errHeadUnavailable
+	}
+	// Some of the desired data does not exist? -> shrink data
+	if offset+uint64(len(data)) > size {
+		data = data[:int(size-offset)]
+	}
+	// The part of the requested data that has not yet been read.
+	// Newer logs store the tail of the stream, hence missing shrinks from its end.
+	missing := util.Span{From: offset, To: offset + uint64(len(data))}
+
 	// Search in the commit log first
-	found := false
-	logIndex := len(f.logReaders)
 	logspan, err := f.log.streamRange(streamName)
 	if err == nil {
-		found = true
-		take := dataspan.Intersect(logspan)
-		if take.IsEmpty() {
-			// The desired data does not exist? -> done
-			if logspan.To <= dataspan.From {
-				return 0, nil
+		take := missing.Intersect(logspan)
+		if !take.IsEmpty() {
+			if _, err = f.log.readStream(streamName, take.From, data[take.From-offset:take.To-offset]); err != nil {
+				return 0, err
 			}
-			// Keep on searching in the older log files
-		} else {
-			// Some of the desired data does not exist? -> shrink data
-			if logspan.To < dataspan.To {
-				data = data[:int(logspan.To-dataspan.From)]
-				dataspan.To = logspan.To
+			missing.To = take.From
+		}
+	} else if err != os.ErrNotExist {
+		return 0, err
+	}
+
+	// Search in all log readers, starting with the most recent one.
+	if missing, err = readLogs(f.pool, f.logReaders, streamName, offset, data, missing); err != nil {
+		return 0, err
+	}
+	if !missing.IsEmpty() {
+		// Some of the first requested bytes could not be found. Perhaps due to pollard.
+		return 0, errHeadUnavailable
+	}
+	return uint64(len(data)), nil
+}
+
+// ReadDirect calls fn with consecutive slices of the stream data, starting at offset and
+// holding up to size bytes in total. It returns the number of bytes passed to fn.
+// If the finalized log files are mapped into memory, their data is passed without copying it.
+// The slices must not be modified and must not be used after fn returns.
+// fn is called without holding any locks, hence it can use the Frontend.
+// Log files compacted meanwhile are kept open until fn has returned.
+func (f *Frontend) ReadDirect(streamName string, offset uint64, size int, fn func(data []byte) error) (n uint64, err error) {
+	slices, pinned, err := f.directSlices(streamName, offset, size)
+	// The slices might point into mapped files. Keep them open until fn has been called
+	defer func() {
+		for _, r := range pinned {
+			f.pool.release(r)
+		}
+	}()
+	if err != nil {
+		return 0, err
+	}
+	for i := len(slices) - 1; i >= 0; i-- {
+		if err := fn(slices[i]); err != nil {
+			return n, err
+		}
+		n += uint64(len(slices[i]))
+	}
+	return n, nil
+}
+
+// directSlices returns the slices passed to fn by ReadDirect in reverse order.
+// It returns the logReaders the slices point into as well.
+// They are pinned and must be released by the caller, even if an error is returned.
+func (f *Frontend) directSlices(streamName string, offset uint64, size int) (slices [][]byte, pinned []*logReader, err error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	streamSize, keep, err := f.streamState(streamName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset >= streamSize {
+		return nil, nil, nil
+	}
+	if offset < keep {
+		return nil, nil, errHeadUnavailable
+	}
+	if offset+uint64(size) > streamSize {
+		size = int(streamSize - offset)
+	}
+	missing := util.Span{From: offset, To: offset + uint64(size)}
+
+	// Search in the commit log first. Newer logs store the tail of the stream
+	logspan, err := f.log.streamRange(streamName)
+	if err == nil {
+		take := missing.Intersect(logspan)
+		if !take.IsEmpty() {
+			data := make([]byte, take.Size())
+			if _, err = f.log.readStream(streamName, take.From, data); err != nil {
+				return nil, nil, err
 			}
-			// Parts of the desired data is in the commit log ?
-			_, err = f.log.readStream(streamName, take.From, data[dataspan.Size()-take.Size():])
-			n = take.Size()
+			slices = append(slices, data)
+			missing.To = take.From
 		}
 	} else if err != os.ErrNotExist {
-		return
+		return nil, nil, err
 	}
 
 	// Search in all log readers, starting with the most recent one.
-	for logIndex = logIndex - 1; n < uint64(len(data)) && logIndex >= 0; logIndex-- {
-		r := f.logReaders[logIndex]
-		if !r.isOpen() {
-			if err = r.open(); err != nil {
-				return 0, err
+	missing, err = searchLogs(f.pool, f.logReaders, streamName, missing, func(r *logReader, e logReaderEntry, take util.Span) error {
+		f.pool.pin(r)
+		pinned = append(pinned, r)
+		s, err := r.slices(e, take.From, int(take.Size()))
+		for i := len(s) - 1; i >= 0; i-- {
+			slices = append(slices, s[i])
+		}
+		return err
+	})
+	if err != nil {
+		return nil, pinned, err
+	}
+	if !missing.IsEmpty() {
+		return nil, pinned, errHeadUnavailable
+	}
+	return slices, pinned, nil
+}
+
+// readLogs reads the missing part of data from the finalized logs, starting with the most recent one.
+// The data buffer holds the stream bytes starting at offset.
+// readLogs returns the part of data that could not be found.
+func readLogs(pool *readerPool, logReaders []*logReader, streamName string, offset uint64, data []byte, missing util.Span) (util.Span, error) {
+	return searchLogs(pool, logReaders, streamName, missing, func(r *logReader, e logReaderEntry, take util.Span) error {
+		return r.read(e, take.From, data[take.From-offset:take.To-offset])
+	})
+}
+
+// searchLogs calls fn for the finalized logs holding the missing stream bytes, starting with the most recent one.
+// Since newer logs store the tail of the stream, missing shrinks from its end.
+// searchLogs returns the part of the stream bytes that could not be found.
+// The logReaders are acquired from the pool. If the pool is nil, the logReaders must be open.
+func searchLogs(pool *readerPool, logReaders []*logReader, streamName string, missing util.Span, fn func(r *logReader, e logReaderEntry, take util.Span) error) (util.Span, error) {
+	for logIndex := len(logReaders) - 1; !missing.IsEmpty() && logIndex >= 0; logIndex-- {
+		r := logReaders[logIndex]
+		if ok, err := r.mayContain(streamName); err != nil {
+			return missing, err
+		} else if !ok {
+			continue
+		}
+		if pool != nil {
+			if err := pool.acquire(r); err != nil {
+				return missing, err
 			}
 		}
 		logentry, err := r.search(streamName)
-		if err == nil {
-			found = true
-			logspan = logentry.span
-			take := dataspan.Intersect(logspan)
-			if take.IsEmpty() {
-				// The desired data does not exist? -> done
-				if logspan.To <= dataspan.From {
-					return 0, nil
-				}
-				// Keep on searching in the older log files
-			} else {
-				// Some of the desired data does not exist? -> shring data
-				if n == 0 && logspan.To < dataspan.To {
-					data = data[:int(logspan.To-dataspan.From)]
-					dataspan.To = logspan.To
-				}
-				// Parts of the desired data is in the commit log ?
-				err = r.read(logentry, take.From, data[dataspan.Size()-take.Size()-n:dataspan.Size()-n])
-				n += take.Size()
-			}
-		} else if err != os.ErrNotExist {
-			return 0, err
+		take := missing.Intersect(logentry.span)
+		// Unless there is a gap in the stream, read the tail of the missing bytes
+		if err == nil && !take.IsEmpty() && take.To == missing.To {
+			err = fn(r, logentry, take)
+		}
+		if pool != nil {
+			pool.release(r)
+		}
+		if err == errStreamDeleted {
+			// Older logs hold data of a deleted stream
+			break
+		} else if err == os.ErrNotExist || (err == nil && take.IsEmpty()) {
+			continue
+		} else if err != nil {
+			return missing, err
+		}
+		if take.To != missing.To {
+			// There is a gap in the stream
+			break
+		}
+		missing.To = take.From
+		if logentry.flags&entryFresh != 0 {
+			// Older logs hold data of a deleted stream
+			break
 		}
 	}
+	return missing, nil
+}
 
-	if !found {
-		// Nothing has been found at all
-		return 0, os.ErrNotExist
+// Append writes data to a stream.
+// If commit is true, Append returns once the data and all data written before has been synced to disk.
+// Otherwise the data is synced to disk lazily. Use Sync or Stat to learn when it is durable.
+// Appends of more than 1GB are rejected.
+func (f *Frontend) Append(streamName string, data []byte, commit bool) error {
+	return f.append(streamName, data, flagAppend, commit)
+}
+
+// append writes data to a stream using an appendAction with the given flags.
+func (f *Frontend) append(streamName string, data []byte, flags actionFlags, commit bool) error {
+	l := f.lockStream(streamName)
+	size, keep, records, err := f.appendState(streamName)
+	var a *appendAction
+	if err == nil {
+		a, err = f.newAppendAction(streamName, data, flags, size, keep, records)
 	}
-	if n != uint64(len(data)) {
-		// Some of the first requested bytes could not be found. Perhaps due to pollard.
-		return 0, errors.New("Head of data unavailable")
+	if err != nil {
+		f.unlockStream(streamName, l)
+		return err
 	}
-	return n, nil
+	f.mutex.Lock()
+	seq, err := f.write(a, commit)
+	if err == nil {
+		f.appended(streamName, seq, size)
+	}
+	f.mutex.Unlock()
+	f.unlockStream(streamName, l)
+	if err != nil || !commit {
+		return err
+	}
+	return f.waitDurable(seq)
 }
 
-// Append writes data to a stream and syncs it to disk when required.
-func (f *Frontend) Append(streamName string, data []byte, commit bool) error {
-	// TODO: commit
-	var a appendAction
-	a.a.flags = flagAppend
+// appendState returns the size, the keepOffset and the number of records of a stream, which are zero
+// if the stream does not exist.
+// The caller must hold the stream lock.
+func (f *Frontend) appendState(streamName string) (size uint64, keep uint64, records uint64, err error) {
+	// The state of the stream cannot change while holding the stream lock.
+	// Hence it can be determined without blocking readers.
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	size, keep, err = f.streamState(streamName)
+	if err == nil {
+		records, err = f.recordCount(streamName)
+	}
+	if err == os.ErrNotExist {
+		return 0, 0, 0, nil
+	}
+	return size, keep, records, err
+}
+
+// newAppendAction returns an appendAction writing data to the stream at offset.
+// The data is compressed and encrypted, which does not block other streams.
+func (f *Frontend) newAppendAction(streamName string, data []byte, flags actionFlags, offset uint64, keep uint64, records uint64) (*appendAction, error) {
+	// A single action must not push the log beyond 4GB
+	if int64(len(data)) > maxLogSize/2 {
+		return nil, errAppendTooLarge
+	}
+	a := &appendAction{data: data}
+	a.a.flags = flags
 	a.a.streamName = streamName
-	a.a.offset = 0
-	stat, err := f.Stat(streamName)
-	if err != nil && err != os.ErrNotExist {
-		return err
-	} else if err == nil {
-		a.a.offset = stat.Size
+	a.a.offset = offset
+	a.a.keepOffset = keep
+	a.a.records = records
+	if err := f.encode(a); err != nil {
+		return nil, err
 	}
-	a.data = data
-	if err = f.log.commit(&a); err != nil {
+	return a, nil
+}
+
+// encode compresses and encrypts the data of the appendAction as configured for its stream.
+func (f *Frontend) encode(a *appendAction) error {
+	if err := a.compress(f.codecFor(a.a.streamName)); err != nil {
 		return err
 	}
-	// TODO: Check for the log file being full
-	return nil
+	return a.encrypt(f.options.Keys)
+}
+
+// appended keeps track of an append to a stream starting at offset from, which has been written
+// with the given sequence number, until it is durable.
+// The caller must hold the mutex for writing.
+func (f *Frontend) appended(streamName string, seq uint64, from uint64) {
+	if seq > f.syncer.durableSeq() {
+		f.pending[streamName] = append(f.prunePending(streamName), pendingAppend{seq: seq, from: from})
+		f.queueNotification(streamName, seq)
+	} else {
+		// Rotating the log made the append durable already
+		f.notifyStream(streamName)
+	}
 }
 
 // Pollard drops data from the beginning of the stream.
 func (f *Frontend) Pollard(streamName string, offset uint64) error {
-	var a pollardAction
-	a.a.flags = flagPollard
+	l := f.lockStream(streamName)
+	seq, err := f.pollard(streamName, offset)
+	f.unlockStream(streamName, l)
+	if err != nil {
+		return err
+	}
+	return f.waitDurable(seq)
+}
+
+// Delete removes a stream. Afterwards the stream is unknown until it is written to again,
+// which creates a new stream starting at offset 0.
+// The data of the deleted stream is dropped when the logs holding it are finalized or compacted.
+func (f *Frontend) Delete(streamName string) error {
+	l := f.lockStream(streamName)
+	f.mutex.RLock()
+	size, keep, err := f.streamState(streamName)
+	var records uint64
+	if err == nil {
+		records, err = f.recordCount(streamName)
+	}
+	f.mutex.RUnlock()
+	if err != nil {
+		f.unlockStream(streamName, l)
+		return err
+	}
+	var a deleteAction
+	a.a.flags = flagDelete
 	a.a.streamName = streamName
-	stat, err := f.Stat(streamName)
+	a.a.offset = size
+	a.a.keepOffset = keep
+	a.a.records = records
+	f.mutex.Lock()
+	seq, err := f.write(&a, true)
+	// Appends of the deleted stream that are still pending must not be reported by Stat
+	delete(f.pending, streamName)
+	f.mutex.Unlock()
+	f.retentionMutex.Lock()
+	delete(f.acks, streamName)
+	f.retentionMutex.Unlock()
+	f.unlockStream(streamName, l)
 	if err != nil {
 		return err
 	}
-	a.a.offset = stat.Size
+	return f.waitDurable(seq)
+}
+
+// pollard writes a pollardAction and returns its sequence number.
+// The caller must hold the stream lock.
+func (f *Frontend) pollard(streamName string, offset uint64) (seq uint64, err error) {
+	f.mutex.RLock()
+	size, keep, err := f.streamState(streamName)
+	var records uint64
+	if err == nil {
+		records, err = f.recordCount(streamName)
+	}
+	f.mutex.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	if offset < keep || offset > size {
+		return 0, os.ErrInvalid
+	}
+	var a pollardAction
+	a.a.flags = flagPollard
+	a.a.streamName = streamName
+	a.a.offset = size
+	a.a.keepOffset = keep
+	a.a.records = records
 	a.pollardPos = offset
-	if err = f.log.commit(&a); err != nil {
-		return err
+	f.mutex.Lock()
+	seq, err = f.write(&a, true)
+	f.mutex.Unlock()
+	return seq, err
+}
+
+// lockStream acquires the lock that serializes appends and pollards of the stream.
+func (f *Frontend) lockStream(streamName string) *streamLock {
+	f.streamLocksMutex.Lock()
+	l, ok := f.streamLocks[streamName]
+	if !ok {
+		l = &streamLock{}
+		f.streamLocks[streamName] = l
 	}
-	// TODO: Check for the log file being full
-	return nil
+	l.refs++
+	f.streamLocksMutex.Unlock()
+	l.mutex.Lock()
+	return l
+}
+
+// unlockStream releases the lock acquired by lockStream.
+func (f *Frontend) unlockStream(streamName string, l *streamLock) {
+	l.mutex.Unlock()
+	f.streamLocksMutex.Lock()
+	l.refs--
+	if l.refs == 0 {
+		delete(f.streamLocks, streamName)
+	}
+	f.streamLocksMutex.Unlock()
+}
+
+// write writes an action to the buffered commit log and rotates the log if required.
+// The returned sequence number can be passed to waitDurable after releasing the mutex.
+// The caller must hold the mutex for writing.
+func (f *Frontend) write(a actionIface, commit bool) (seq uint64, err error) {
+	if f.log == nil {
+		return 0, os.ErrClosed
+	}
+	// A rotation that failed before must succeed before the log grows too large
+	if f.log.finalized || int64(f.log.size) >= maxLogSize {
+		if err = f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if err = f.log.append(a); err != nil {
+		return 0, err
+	}
+	f.written++
+	seq = f.written
+	if !commit && f.log.size-f.log.synced >= f.options.FlushSize {
+		f.syncer.trigger()
+	}
+	// The action has been written, hence a failed rotation is not reported. The next write tries again.
+	f.rotate()
+	return seq, nil
+}
+
+// waitDurable blocks until the action with the given sequence number has been synced to disk.
+func (f *Frontend) waitDurable(seq uint64) error {
+	return f.syncer.waitDurable(seq)
 }
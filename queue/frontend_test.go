@@ -1,8 +1,15 @@
 package queue
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestFrontend(t *testing.T) {
@@ -38,4 +45,2052 @@ func TestFrontend(t *testing.T) {
 		t.Fatal(n, string(buffer[:3]), err)
 	}
 	f.Close()
+	// Closing twice has no effect
+	f.Close()
+	if _, err := f.Stat("ps1"); err != os.ErrClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestFrontendRotation(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []byte
+	for i := 0; i < 20; i++ {
+		data := []byte(fmt.Sprintf("<%02d-abcdefghijklmnopqrstuvwxyz>", i))
+		all = append(all, data...)
+		if err := f.Append("s1", data, true); err != nil {
+			t.Fatal(err)
+		}
+		if i%4 == 0 {
+			if err := f.Append("s2", []byte{byte(i)}, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(f.logReaders) < 5 {
+		t.Fatal("Log has not been rotated", len(f.logReaders))
+	}
+	if err := f.Pollard("s1", 40); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(f *Frontend) {
+		stat, err := f.Stat("s1")
+		if err != nil || stat.Size != uint64(len(all)) {
+			t.Fatal(stat.Size, err)
+		}
+		buf := make([]byte, len(all))
+		n, err := f.Read("s1", 40, buf)
+		if err != nil || n != uint64(len(all)-40) || string(buf[:n]) != string(all[40:]) {
+			t.Fatal(n, err, string(buf[:n]))
+		}
+		if _, err = f.Read("s1", 39, buf[:10]); err != errHeadUnavailable {
+			t.Fatal(err)
+		}
+		n, err = f.Read("s2", 0, buf)
+		if err != nil || n != 5 || string(buf[:n]) != "\x00\x04\x08\x0c\x10" {
+			t.Fatal(n, err, buf[:n])
+		}
+	}
+	check(f)
+	f.Close()
+
+	f, err = NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(f)
+	f.Close()
+}
+
+// faultyStorage fails to sync files while failSync is set.
+type faultyStorage struct {
+	Storage
+	mutex    sync.Mutex
+	failSync bool
+}
+
+type faultyFile struct {
+	File
+	s *faultyStorage
+}
+
+var errFaulty = errors.New("Injected fault")
+
+func (s *faultyStorage) setFailSync(fail bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failSync = fail
+}
+
+func (s *faultyStorage) Create(name string) (File, error) {
+	f, err := s.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: f, s: s}, nil
+}
+
+func (s *faultyStorage) OpenWrite(name string) (File, error) {
+	f, err := s.Storage.OpenWrite(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: f, s: s}, nil
+}
+
+func (f *faultyFile) Sync() error {
+	f.s.mutex.Lock()
+	fail := f.s.failSync
+	f.s.mutex.Unlock()
+	if fail {
+		return errFaulty
+	}
+	return f.File.Sync()
+}
+
+func TestFrontendFinalizeFailure(t *testing.T) {
+	storage := &faultyStorage{Storage: NewMemoryStorage()}
+	const dir = "test"
+	options := Options{MaxLogSize: 100, Storage: storage, FlushInterval: time.Hour, FlushSize: 1 << 20}
+	f, err := NewFrontendWithOptions(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Appends that are written are not reported as failed, although finalizing the log fails
+	storage.setFailSync(true)
+	var all []byte
+	for i := 0; i < 5; i++ {
+		data := []byte(fmt.Sprintf("<%02d-abcdefghijklmnopqrstuvwxyz>", i))
+		all = append(all, data...)
+		if err := f.Append("s1", data, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(f.logReaders) != 0 {
+		t.Fatal("The log has been finalized", len(f.logReaders))
+	}
+	// The next append finalizes the log
+	storage.setFailSync(false)
+	data := []byte("<05-abcdefghijklmnopqrstuvwxyz>")
+	all = append(all, data...)
+	if err := f.Append("s1", data, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.logReaders) != 1 {
+		t.Fatal("The log has not been finalized", len(f.logReaders))
+	}
+	f.Close()
+
+	// No append has been dropped behind a partial dict
+	f, err = NewFrontendWithOptions(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if r := f.Recovery(); r.Dropped != 0 {
+		t.Fatal(r)
+	}
+	buf := make([]byte, len(all))
+	if n, err := f.Read("s1", 0, buf); err != nil || string(buf[:n]) != string(all) {
+		t.Fatal(n, err, string(buf[:n]))
+	}
+}
+
+func TestFrontendMaxLogSize(t *testing.T) {
+	defer func(size int64) { maxLogSize = size }(maxLogSize)
+	maxLogSize = 100
+	dir := t.TempDir()
+	if _, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 101}); err != errMaxLogSize {
+		t.Fatal(err)
+	}
+	// Logs are rotated at maxLogSize even if size based rotation is disabled
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := []byte("<abcdefghijklmnopqrstuvwxyz>")
+	for i := 0; i < 10; i++ {
+		if err := f.Append("s1", data, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each log holds the appends written until it reached maxLogSize
+	if len(f.logReaders) < 3 {
+		t.Fatal("Log has not been rotated", len(f.logReaders))
+	}
+	if err := f.Append("s1", make([]byte, 51), true); err != errAppendTooLarge {
+		t.Fatal(err)
+	}
+	if err := f.AppendBatch([]Append{{StreamName: "s1", Data: data}, {StreamName: "s2", Data: data}}); err != errAppendTooLarge {
+		t.Fatal(err)
+	}
+}
+
+func TestFrontendCompaction(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []byte
+	for i := 0; i < 20; i++ {
+		data := []byte(fmt.Sprintf("<%02d-abcdefghijklmnopqrstuvwxyz>", i))
+		all = append(all, data...)
+		if err := f.Append("s1", data, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Append("s2", []byte{byte(i)}, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Pollard("s1", 500); err != nil {
+		t.Fatal(err)
+	}
+	logs := len(f.logFiles)
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.logFiles) != 2 || len(f.logReaders) != 1 {
+		t.Fatal("Wrong number of logs", logs, len(f.logFiles))
+	}
+	names, err := os.ReadDir(dir)
+	if err != nil || len(names) != 2 {
+		t.Fatal("Wrong number of files", len(names), err)
+	}
+
+	check := func(f *Frontend) {
+		stat, err := f.Stat("s1")
+		if err != nil || stat.Size != uint64(len(all)) {
+			t.Fatal(stat.Size, err)
+		}
+		buf := make([]byte, len(all))
+		n, err := f.Read("s1", 500, buf)
+		if err != nil || n != uint64(len(all)-500) || string(buf[:n]) != string(all[500:]) {
+			t.Fatal(n, err, string(buf[:n]))
+		}
+		n, err = f.Read("s2", 0, buf)
+		if err != nil || n != 20 || buf[19] != 19 {
+			t.Fatal(n, err, buf[:n])
+		}
+	}
+	check(f)
+	// The pollarded bytes are gone
+	e, err := f.logReaders[0].search("s1")
+	if err != nil || e.span.From != 500 {
+		t.Fatal(e.span, err)
+	}
+	f.Close()
+
+	f, err = NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(f)
+	// Keep appending
+	if err := f.Append("s2", []byte{20}, true); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestFrontendCompactionInterrupted(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		options := Options{MaxLogSize: 100, Storage: storage}
+		f, err := NewFrontendWithOptions(dir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 4; i++ {
+			if err := f.Append("x", []byte("<abcdefghijklmnopqrstuvwxyz>"), true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := f.Delete("x"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 4; i++ {
+			if err := f.Append("s1", []byte("<abcdefghijklmnopqrstuvwxyz>"), true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Remember the log files merged by the compaction
+		saved := make(map[string][]byte)
+		for _, n := range f.logFiles[:len(f.logFiles)-1] {
+			if saved[n], err = readFile(storage, n); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := f.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		// Simulate a crash before the merged log files have been removed
+		restored := 0
+		for n, data := range saved {
+			if _, err := storage.Stat(n); os.IsNotExist(err) {
+				if err := writeFile(storage, n, data); err != nil {
+					t.Fatal(err)
+				}
+				restored++
+			}
+		}
+		if restored < 2 {
+			t.Fatal("Too few logs have been merged", restored)
+		}
+		report, err := CheckStorage(storage, dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != restored || !report.Recoverable() {
+			t.Fatal(report.Problems)
+		}
+
+		f, err = NewFrontendWithOptions(dir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Stat("x"); err != os.ErrNotExist {
+			t.Fatal("The deleted stream is back", err)
+		}
+		if stat, err := f.Stat("s1"); err != nil || stat.Size != 4*28 {
+			t.Fatal(stat, err)
+		}
+		f.Close()
+		// Only the compacted log is left
+		for n := range saved {
+			if _, err := storage.Stat(n); err == nil {
+				restored++
+			}
+		}
+		if restored != len(saved) {
+			t.Fatal("Merged logs have not been removed", restored, len(saved))
+		}
+		if report, err = CheckStorage(storage, dir, nil); err != nil || len(report.Problems) != 0 {
+			t.Fatal(err, report.Problems)
+		}
+	})
+}
+
+func TestFrontendCompactionWindow(t *testing.T) {
+	defer func(size int64) { maxCompactionSize = size }(maxCompactionSize)
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		maxCompactionSize = 1 << 31
+		options := Options{MaxLogSize: 100, Storage: storage}
+		f, err := NewFrontendWithOptions(dir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte("<abcdefghijklmnopqrstuvwxyz>")
+		for i := 0; i < 6; i++ {
+			for _, n := range []string{"deleted", "recreated", "kept"} {
+				if err := f.Append(n, data, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := f.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		oldest := f.logFiles[0]
+		content, err := readFile(storage, oldest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The compacted log is too large to be merged with any other log, but two other logs can be merged
+		maxCompactionSize = int64(len(content))
+
+		if err := f.Delete("deleted"); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Delete("recreated"); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 4; i++ {
+			if err := f.Append("recreated", data[:10], true); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Append("kept", data, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		saved := make(map[string][]byte)
+		for _, n := range f.logFiles[1 : len(f.logFiles)-1] {
+			if saved[n], err = readFile(storage, n); err != nil {
+				t.Fatal(err)
+			}
+		}
+		logs := len(f.logFiles)
+		if err := f.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if len(f.logFiles) >= logs || f.logFiles[0] != oldest {
+			t.Fatal("The compaction did not skip the large log", logs, f.logFiles)
+		}
+		if c, err := readFile(storage, oldest); err != nil || string(c) != string(content) {
+			t.Fatal("The large log has been rewritten", err)
+		}
+		check := func(f *Frontend) {
+			t.Helper()
+			// Deletions in the merged logs hide the data in the older log
+			if _, err := f.Stat("deleted"); err != os.ErrNotExist {
+				t.Fatal("The deleted stream is back", err)
+			}
+			if stat, err := f.Stat("recreated"); err != nil || stat.Size != 40 {
+				t.Fatal(stat, err)
+			}
+			buf := make([]byte, 10*28)
+			if n, err := f.Read("recreated", 0, buf[:40]); err != nil || n != 40 || string(buf[:40]) != strings.Repeat(string(data[:10]), 4) {
+				t.Fatal(n, err, string(buf[:40]))
+			}
+			if n, err := f.Read("kept", 0, buf); err != nil || n != 10*28 || string(buf[n-28:n]) != string(data) {
+				t.Fatal(n, err)
+			}
+		}
+		check(f)
+		f.Close()
+
+		// Simulate a crash before the merged log files have been removed
+		restored := 0
+		for n, data := range saved {
+			if _, err := storage.Stat(n); os.IsNotExist(err) {
+				if err := writeFile(storage, n, data); err != nil {
+					t.Fatal(err)
+				}
+				restored++
+			}
+		}
+		if restored == 0 {
+			t.Fatal("No logs have been merged")
+		}
+		report, err := CheckStorage(storage, dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != restored || !report.Recoverable() {
+			t.Fatal(report.Problems)
+		}
+		// Only the merged log files are removed, not the older one
+		f, err = NewFrontendWithOptions(dir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.logFiles[0] != oldest {
+			t.Fatal("The large log has been removed", f.logFiles)
+		}
+		check(f)
+		f.Close()
+		if report, err = CheckStorage(storage, dir, nil); err != nil || len(report.Problems) != 0 {
+			t.Fatal(err, report.Problems)
+		}
+	})
+}
+
+func TestFrontendRecords(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []string
+	for i := 0; i < 20; i++ {
+		// Every third record is written with two appends and every fifth record is empty
+		record := fmt.Sprintf("<record %02d>", i)
+		if i%5 == 4 {
+			record = ""
+		}
+		if i%3 == 0 && record != "" {
+			if err := f.Append("s1", []byte(record[:3]), false); err != nil {
+				t.Fatal(err)
+			}
+			err = f.AppendRecord("s1", []byte(record[3:]), true)
+		} else {
+			err = f.AppendRecord("s1", []byte(record), true)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	// An incomplete record
+	if err := f.Append("s1", []byte("<incomplete"), true); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.logFiles) < 3 {
+		t.Fatal("Records do not span several logs", len(f.logFiles))
+	}
+
+	check := func(f *Frontend, first int) {
+		count, err := f.RecordCount("s1")
+		if err != nil || count != 20 {
+			t.Fatal(count, err)
+		}
+		for i := first; i < 20; i++ {
+			data, err := f.ReadRecord("s1", uint64(i))
+			if err != nil || string(data) != records[i] {
+				t.Fatal(i, string(data), err)
+			}
+		}
+		if first > 0 {
+			if _, err := f.ReadRecord("s1", uint64(first-1)); err != errHeadUnavailable {
+				t.Fatal(err)
+			}
+		}
+		if _, err := f.ReadRecord("s1", 20); err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+	check(f, 0)
+	if _, err := f.RecordCount("s2"); err != os.ErrNotExist {
+		t.Fatal(err)
+	}
+
+	if err := f.PollardRecords("s1", 7); err != nil {
+		t.Fatal(err)
+	}
+	check(f, 7)
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(f, 7)
+	f.Close()
+
+	f, err = NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(f, 7)
+	// Complete the record
+	if err := f.AppendRecord("s1", []byte(">"), true); err != nil {
+		t.Fatal(err)
+	}
+	data, err := f.ReadRecord("s1", 20)
+	if err != nil || string(data) != "<incomplete>" {
+		t.Fatal(string(data), err)
+	}
+	if err := f.PollardRecords("s1", 21); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	count, err := f.RecordCount("s1")
+	if err != nil || count != 21 {
+		t.Fatal(count, err)
+	}
+	if _, err := f.ReadRecord("s1", 20); err != errHeadUnavailable {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestFrontendMmap(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 100, MmapLogs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []byte
+	for i := 0; i < 20; i++ {
+		data := []byte(fmt.Sprintf("<%02d-abcdefghijklmnopqrstuvwxyz>", i))
+		all = append(all, data...)
+		if err := f.Append("s1", data, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Pollard("s1", 50); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(all))
+	n, err := f.Read("s1", 50, buf)
+	if err != nil || string(buf[:n]) != string(all[50:]) {
+		t.Fatal(n, err, string(buf[:n]))
+	}
+	for _, r := range f.logReaders {
+		if r.data == nil {
+			t.Fatal("Log is not mapped", r.filename)
+		}
+	}
+
+	var got []byte
+	slices := 0
+	n, err = f.ReadDirect("s1", 60, len(all), func(data []byte) error {
+		got = append(got, data...)
+		slices++
+		return nil
+	})
+	if err != nil || n != uint64(len(all)-60) || string(got) != string(all[60:]) {
+		t.Fatal(n, err, string(got))
+	}
+	// Each finalized log holding requested data delivers its own slice
+	logs := 0
+	for _, r := range f.logReaders {
+		if e, err := r.search("s1"); err == nil && e.span.To > 60 {
+			logs++
+		}
+	}
+	if logs < 2 || slices < logs {
+		t.Fatal("Data has been copied", slices, logs)
+	}
+	if _, err := f.ReadDirect("s1", 0, 10, func(data []byte) error { return nil }); err != errHeadUnavailable {
+		t.Fatal(err)
+	}
+	// fn can use the Frontend. The slices stay valid while their logs are compacted
+	got = nil
+	compacted := false
+	if _, err = f.ReadDirect("s1", 50, len(all), func(data []byte) error {
+		if !compacted {
+			compacted = true
+			if err := f.Compact(); err != nil {
+				return err
+			}
+		}
+		got = append(got, data...)
+		return nil
+	}); err != nil || string(got) != string(all[50:]) {
+		t.Fatal(err, string(got))
+	}
+	// The logReaders of the compacted logs have been closed once ReadDirect returned
+	if stats := f.ReaderPoolStats(); stats.Open > len(f.logReaders) {
+		t.Fatal(stats.Open, len(f.logReaders))
+	}
+	got = nil
+	if _, err = f.ReadDirect("s1", 50, len(all), func(data []byte) error {
+		got = append(got, data...)
+		return nil
+	}); err != nil || string(got) != string(all[50:]) {
+		t.Fatal(err, string(got))
+	}
+	f.Close()
+}
+
+func TestFrontendReaderPool(t *testing.T) {
+	dir := t.TempDir()
+	for _, mmap := range []bool{false, true} {
+		f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 100, MaxOpenLogs: 2, MmapLogs: mmap})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !mmap {
+			for i := 0; i < 10; i++ {
+				if err := f.Append(fmt.Sprintf("s%d", i), []byte(fmt.Sprintf("<%d-abcdefghijklmnopqrstuvwxyz-abcdefghijklmnopqrstuvwxyz>", i)), true); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if len(f.logReaders) < 5 {
+			t.Fatal("Too few logs", len(f.logReaders))
+		}
+		// Read all streams twice
+		for j := 0; j < 2; j++ {
+			for i := 0; i < 10; i++ {
+				var buf [3]byte
+				n, err := f.ReadDirect(fmt.Sprintf("s%d", i), 0, 3, func(data []byte) error {
+					copy(buf[:], data)
+					return nil
+				})
+				if err != nil || n != 3 || string(buf[:]) != fmt.Sprintf("<%d-", i) {
+					t.Fatal(i, n, err, string(buf[:]))
+				}
+			}
+		}
+		stats := f.ReaderPoolStats()
+		if stats.Open > 2 || stats.Evictions == 0 || stats.Misses <= uint64(len(f.logReaders)) || stats.Hits == 0 {
+			t.Fatal(stats)
+		}
+		open := 0
+		for _, r := range f.logReaders {
+			if r.f != nil {
+				open++
+			}
+		}
+		if open != stats.Open {
+			t.Fatal(open, stats.Open)
+		}
+		f.Close()
+		if stats := f.ReaderPoolStats(); stats.Open != 0 || stats.DictMemory != 0 {
+			t.Fatal(stats)
+		}
+	}
+}
+
+func TestFrontendDelete(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill := func(streamName string, count int) {
+		for i := 0; i < count; i++ {
+			if err := f.AppendRecord(streamName, []byte(fmt.Sprintf("<%02d-abcdefghijklmnopqrstuvwxyz>", i)), true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	fill("s1", 10)
+	fill("s2", 1)
+	if err := f.Delete("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Delete("s1"); err != os.ErrNotExist {
+		t.Fatal(err)
+	}
+	deleted := func() {
+		if _, err := f.Stat("s1"); err != os.ErrNotExist {
+			t.Fatal(err)
+		}
+		var buf [10]byte
+		if _, err := f.Read("s1", 0, buf[:]); err != os.ErrNotExist {
+			t.Fatal(err)
+		}
+		if _, err := f.RecordCount("s1"); err != os.ErrNotExist {
+			t.Fatal(err)
+		}
+	}
+	deleted()
+	// Deletion survives rotation
+	fill("s2", 5)
+	deleted()
+
+	// Recreate the stream
+	if err := f.AppendRecord("s1", []byte("new"), true); err != nil {
+		t.Fatal(err)
+	}
+	recreated := func(f *Frontend) {
+		stat, err := f.Stat("s1")
+		if err != nil || stat.Size != 3 {
+			t.Fatal(stat, err)
+		}
+		buf := make([]byte, 100)
+		if n, err := f.Read("s1", 0, buf); err != nil || string(buf[:n]) != "new" {
+			t.Fatal(string(buf[:n]), err)
+		}
+		if count, err := f.RecordCount("s1"); err != nil || count != 1 {
+			t.Fatal(count, err)
+		}
+		if data, err := f.ReadRecord("s1", 0); err != nil || string(data) != "new" {
+			t.Fatal(string(data), err)
+		}
+	}
+	recreated(f)
+	fill("s2", 5)
+	recreated(f)
+	f.Close()
+
+	f, err = NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recreated(f)
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	recreated(f)
+
+	// Compaction drops deleted streams
+	if err := f.Delete("s1"); err != nil {
+		t.Fatal(err)
+	}
+	fill("s2", 5)
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	deleted()
+	if len(f.logReaders) != 1 {
+		t.Fatal(len(f.logReaders))
+	}
+	if err := f.logReaders[0].ensureOpen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.logReaders[0].search("s1"); err != os.ErrNotExist {
+		t.Fatal(err)
+	}
+	if count, err := f.RecordCount("s2"); err != nil || count != 16 {
+		t.Fatal(count, err)
+	}
+	f.Close()
+}
+
+func TestFrontendList(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := make(map[string]uint64)
+	for i := 0; i < 30; i++ {
+		streamName := fmt.Sprintf("bundle%d/user%02d", i%3, i)
+		data := []byte(fmt.Sprintf("<%02d-abcdefghijklmnopqrstuvwxyz>", i))
+		if err := f.Append(streamName, data, true); err != nil {
+			t.Fatal(err)
+		}
+		sizes[streamName] += uint64(len(data))
+	}
+	// Append to an old stream, which is now stored in several logs
+	if err := f.Append("bundle1/user01", []byte("more"), true); err != nil {
+		t.Fatal(err)
+	}
+	sizes["bundle1/user01"] += 4
+	if err := f.Delete("bundle1/user04"); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(prefix string) []string {
+		var names []string
+		it := f.List(prefix)
+		for it.Next() {
+			if it.Stat().Size != sizes[it.Name()] {
+				t.Fatal(it.Name(), it.Stat(), sizes[it.Name()])
+			}
+			names = append(names, it.Name())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	names := list("bundle1/")
+	if len(names) != 9 || names[0] != "bundle1/user01" || names[1] != "bundle1/user07" || names[8] != "bundle1/user28" {
+		t.Fatal(names)
+	}
+	if names := list(""); len(names) != 29 || names[0] != "bundle0/user00" || names[28] != "bundle2/user29" {
+		t.Fatal(names)
+	}
+	if names := list("bundle2/user1"); len(names) != 3 || names[0] != "bundle2/user11" {
+		t.Fatal(names)
+	}
+	if names := list("bundle3"); len(names) != 0 {
+		t.Fatal(names)
+	}
+	f.Close()
+	if it := f.List(""); it.Next() || it.Err() != os.ErrClosed {
+		t.Fatal(it.Err())
+	}
+}
+
+func TestFrontendGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 2000, GroupCommitWindow: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- f.Append(fmt.Sprintf("s%02d", i), []byte(fmt.Sprintf("Hello %02d", i)), true)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.syncer.durable != count {
+		t.Fatal("Not all appends are durable", f.syncer.durable)
+	}
+	if f.syncer.syncs >= count {
+		t.Fatal("Syncs have not been coalesced", f.syncer.syncs)
+	}
+	f.Close()
+
+	f, err = NewFrontend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		var buf [8]byte
+		n, err := f.Read(fmt.Sprintf("s%02d", i), 0, buf[:])
+		if err != nil || n != 8 || string(buf[:]) != fmt.Sprintf("Hello %02d", i) {
+			t.Fatal(n, err, string(buf[:n]))
+		}
+	}
+	f.Close()
+}
+
+func TestFrontendDeferredCommit(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Append("s1", []byte("Hello "), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Append("s1", []byte("World"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Append("s1", []byte("!"), false); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat("s1")
+	if err != nil || stat.Size != 12 || stat.DurableSize != 6 {
+		t.Fatal(stat, err)
+	}
+	// Data that is not durable yet can be read
+	var buf [12]byte
+	n, err := f.Read("s1", 0, buf[:])
+	if err != nil || n != 12 || string(buf[:]) != "Hello World!" {
+		t.Fatal(n, err, string(buf[:n]))
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	stat, err = f.Stat("s1")
+	if err != nil || stat.Size != 12 || stat.DurableSize != 12 {
+		t.Fatal(stat, err)
+	}
+
+	// A committed append makes everything before it durable
+	if err := f.Append("s2", []byte("abc"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Append("s1", []byte("?"), true); err != nil {
+		t.Fatal(err)
+	}
+	stat, err = f.Stat("s2")
+	if err != nil || stat.Size != 3 || stat.DurableSize != 3 {
+		t.Fatal(stat, err)
+	}
+	// Durable appends are forgotten, although s2 is not written to again
+	pending := 0
+	for i := 0; i < 100; i++ {
+		f.mutex.RLock()
+		pending = len(f.pending)
+		f.mutex.RUnlock()
+		if pending == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pending != 0 {
+		t.Fatal("Pending appends of", pending, "streams")
+	}
+	f.Close()
+
+	// Flushing is triggered by size
+	f, err = NewFrontendWithOptions(dir, Options{FlushInterval: time.Hour, FlushSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Append("s3", []byte("0123456789"), false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if stat, err = f.Stat("s3"); err != nil || stat.DurableSize == 10 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || stat.DurableSize != 10 {
+		t.Fatal(stat, err)
+	}
+	f.Close()
+}
+
+func TestFrontendConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 4000, GroupCommitWindow: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers = 4
+	const appends = 200
+	chunk := func(w, i int) string {
+		return fmt.Sprintf("[%d:%03d]", w, i)
+	}
+	errs := make(chan error, 3*writers+1)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		// Writers append to their own stream and pollard it from time to time
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			name := fmt.Sprintf("s%d", w)
+			for i := 0; i < appends; i++ {
+				if err := f.Append(name, []byte(chunk(w, i)), i%3 == 0); err != nil {
+					errs <- err
+					return
+				}
+				if i%50 == 49 {
+					if err := f.Pollard(name, uint64((i-10)*len(chunk(w, i)))); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+		// Readers read the tail of the streams written by the writers
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			name := fmt.Sprintf("s%d", w)
+			size := uint64(len(chunk(w, 0)))
+			for i := 0; i < appends; i++ {
+				stat, err := f.Stat(name)
+				if err == os.ErrNotExist {
+					continue
+				} else if err != nil {
+					errs <- err
+					return
+				}
+				if stat.Size%size != 0 || stat.Size == 0 {
+					errs <- fmt.Errorf("Wrong size %v", stat.Size)
+					return
+				}
+				buf := make([]byte, size)
+				n, err := f.Read(name, stat.Size-size, buf)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if string(buf[:n]) != chunk(w, int(stat.Size/size)-1) {
+					errs <- fmt.Errorf("Wrong data %v", string(buf[:n]))
+					return
+				}
+			}
+		}(w)
+		// Appends to a shared stream keep their order per goroutine
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < appends/4; i++ {
+				if err := f.Append("shared", []byte(chunk(w, i)), false); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			if err := f.Compact(); err != nil {
+				errs <- err
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the shared stream
+	size := len(chunk(0, 0))
+	buf := make([]byte, writers*appends/4*size)
+	n, err := f.Read("shared", 0, buf)
+	if err != nil || int(n) != len(buf) {
+		t.Fatal(n, err)
+	}
+	next := make([]int, writers)
+	for pos := 0; pos < len(buf); pos += size {
+		var w, i int
+		if _, err := fmt.Sscanf(string(buf[pos:pos+size]), "[%d:%d]", &w, &i); err != nil {
+			t.Fatal(err)
+		}
+		if next[w] != i {
+			t.Fatal("Wrong order", w, i)
+		}
+		next[w]++
+	}
+	f.Close()
+}
+
+func TestFrontendSubscribe(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Append("s1", []byte("Hello "), true); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := f.Subscribe("s1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := f.Subscribe("s2", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf [20]byte
+	var got []byte
+	receive := func(expected string) {
+		for string(got) != expected {
+			select {
+			case <-sub.Notify:
+			case <-time.After(5 * time.Second):
+				t.Fatal("No notification", string(got))
+			}
+			n, err := sub.Read(buf[:4])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, buf[:n]...)
+		}
+	}
+	// Data written before subscribing is delivered
+	receive("Hello ")
+
+	// Data which is not durable is not delivered
+	if err := f.Append("s1", []byte("World"), false); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := sub.Read(buf[:]); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	if err := f.Append("s1", []byte("!"), true); err != nil {
+		t.Fatal(err)
+	}
+	receive("Hello World!")
+	if sub.Offset() != 12 {
+		t.Fatal(sub.Offset())
+	}
+
+	// Subscriptions of other streams are not notified
+	select {
+	case <-other.Notify:
+		t.Fatal("Wrong notification")
+	default:
+	}
+
+	sub.Cancel()
+	if _, ok := <-sub.Notify; ok {
+		t.Fatal("Notify is not closed")
+	}
+
+	// Reading while the subscription is canceled does not notify the closed channel
+	for i := 0; i < 100; i++ {
+		s, err := f.Subscribe("s1", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.Read(buf[:1])
+		}()
+		s.Cancel()
+		<-done
+	}
+	f.Close()
+	if _, ok := <-other.Notify; ok {
+		t.Fatal("Notify is not closed")
+	}
+}
+
+func TestFrontendSubscribePending(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Data which is not durable yet when subscribing is announced once it is synced
+	if err := f.Append("s1", []byte("Hello"), false); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := f.Subscribe("s1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sub.Notify:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No notification")
+	}
+	var buf [10]byte
+	if n, err := sub.Read(buf[:]); err != nil || string(buf[:n]) != "Hello" {
+		t.Fatal(n, err)
+	}
+}
+
+func TestFrontendRetention(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 100, RetentionInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("0123456789")
+	for i := 0; i < 10; i++ {
+		for _, streamName := range []string{"tmp/a", "tmp/acked", "keep"} {
+			if err := f.Append(streamName, data, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := f.AppendRecord("rec/a", data, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.SetRetention("tmp/", RetentionPolicy{MaxBytes: 25})
+	f.SetRetention("tmp/acked", RetentionPolicy{Acknowledged: true})
+	f.SetRetention("rec/", RetentionPolicy{MaxBytes: 25})
+	if err := f.Acknowledge("tmp/acked", 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Acknowledge("tmp/acked", 101); err != os.ErrInvalid {
+		t.Fatal(err)
+	}
+	if err := f.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	checkKeep := func(streamName string, keep uint64) {
+		var buf [1]byte
+		if _, err := f.Read(streamName, keep-1, buf[:]); err != errHeadUnavailable {
+			t.Fatal(streamName, err)
+		}
+		if n, err := f.Read(streamName, keep, buf[:]); n != 1 || err != nil {
+			t.Fatal(streamName, n, err)
+		}
+	}
+	checkKeep("tmp/a", 75)
+	// The policy of the longest prefix applies
+	checkKeep("tmp/acked", 42)
+	// Records are dropped entirely
+	checkKeep("rec/a", 70)
+	if _, err := f.ReadRecord("rec/a", 7); err != nil {
+		t.Fatal(err)
+	}
+	// Streams without a policy keep all data
+	var buf [100]byte
+	if n, err := f.Read("keep", 0, buf[:]); n != 100 || err != nil {
+		t.Fatal(n, err)
+	}
+
+	// Enforcing again does not change anything
+	if err := f.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	checkKeep("tmp/a", 75)
+	f.SetRetention("tmp/", RetentionPolicy{})
+	if err := f.Append("tmp/a", data, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.EnforceRetention(); err != nil {
+		t.Fatal(err)
+	}
+	checkKeep("tmp/a", 75)
+	f.Close()
+
+	// Age based retention for data in the commit log and in finalized logs
+	for _, maxLogSize := range []int64{0, 1} {
+		f, err := NewFrontendWithOptions(t.TempDir(), Options{MaxLogSize: maxLogSize, RetentionInterval: 10 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := f.Append("old", data, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(300 * time.Millisecond)
+		if err := f.Append("old", data, true); err != nil {
+			t.Fatal(err)
+		}
+		f.SetRetention("old", RetentionPolicy{MaxAge: 200 * time.Millisecond})
+		// The policy is enforced in the background
+		var buf [1]byte
+		for i := 0; i < 100; i++ {
+			if _, err = f.Read("old", 99, buf[:]); err == errHeadUnavailable {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != errHeadUnavailable {
+			t.Fatal(maxLogSize, err)
+		}
+		if n, err := f.Read("old", 100, buf[:]); n != 1 || err != nil {
+			t.Fatal(maxLogSize, n, err)
+		}
+		f.Close()
+	}
+}
+
+func TestFrontendOffsetForTime(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("0123456789")
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := f.Append("s1", data, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 6; i++ {
+		if err := f.Append("s1", data, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(tm time.Time, expected uint64) {
+		offset, err := f.OffsetForTime("s1", tm)
+		if err != nil || offset != expected {
+			t.Fatal(offset, err, expected)
+		}
+	}
+	check(start, 0)
+	check(middle, 60)
+	check(time.Now(), 120)
+	f.Close()
+
+	// Commit times survive recovery and compaction
+	f, err = NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(start, 0)
+	check(middle, 60)
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(start, 0)
+	check(middle, 60)
+	// Pollarded bytes are skipped
+	if err := f.Pollard("s1", 42); err != nil {
+		t.Fatal(err)
+	}
+	check(start, 42)
+	check(middle, 60)
+	if _, err := f.OffsetForTime("s2", start); err != os.ErrNotExist {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestFrontendSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []byte
+	for i := 0; i < 20; i++ {
+		data := []byte(fmt.Sprintf("<%02d-abcdefghijklmnopqrstuvwxyz>", i))
+		all = append(all, data...)
+		if err := f.Append("s1", data, i%3 == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Appends continue while the snapshot is taken
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 50; i++ {
+			if err := f.Append("s2", []byte("more"), false); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+	if err := f.Snapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Snapshot(snapshot); err != os.ErrExist {
+		t.Fatal(err)
+	}
+	// Changing the store does not change the snapshot
+	if err := f.Append("s1", []byte("later"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	f, err = NewFrontend(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := f.Stat("s1")
+	if err != nil || stat.Size != uint64(len(all)) {
+		t.Fatal(stat, err)
+	}
+	buf := make([]byte, len(all))
+	if n, err := f.Read("s1", 0, buf); err != nil || string(buf[:n]) != string(all) {
+		t.Fatal(n, err, string(buf[:n]))
+	}
+	if stat, err := f.Stat("s2"); err == nil && stat.Size%4 != 0 {
+		t.Fatal(stat)
+	}
+	f.Close()
+}
+
+func TestFrontendCheck(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		data := []byte(fmt.Sprintf("<%02d-abcdefghijklmnopqrstuvwxyz>", i))
+		if err := f.AppendRecord(fmt.Sprintf("s%d", i%3), data, true); err != nil {
+			t.Fatal(err)
+		}
+		if i == 10 {
+			if err := f.Pollard("s1", 40); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Delete("s2"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i == 15 {
+			if err := f.Compact(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := f.Append("s0", []byte("tail"), true); err != nil {
+		t.Fatal(err)
+	}
+	files := append([]string{}, f.logFiles...)
+	if len(files) < 5 {
+		t.Fatal(files)
+	}
+	f.Close()
+
+	report, err := Check(dir)
+	if err != nil || len(report.Problems) != 0 || report.Logs != len(files)-1 || report.Streams != 3 {
+		t.Fatal(report, err)
+	}
+
+	// A torn action at the end of the commit log is repaired by recovery
+	commit, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit.Write([]byte{byte(flagAppend), 1, 2})
+	commit.Close()
+	report, err = Check(dir)
+	if err != nil || len(report.Problems) != 1 || !report.Recoverable() {
+		t.Fatal(report, err)
+	}
+
+	// A missing log breaks the continuity of the streams
+	if err := os.Remove(files[len(files)-4]); err != nil {
+		t.Fatal(err)
+	}
+	report, err = Check(dir)
+	if err != nil || report.Recoverable() {
+		t.Fatal(report, err)
+	}
+
+	// Corrupt data is detected
+	data, err := os.ReadFile(files[len(files)-2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[headerSize+20] ^= 0xff
+	if err := os.WriteFile(files[len(files)-2], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := false
+	for _, p := range report.Problems {
+		if p.File == filepath.Base(files[len(files)-2]) && p.Stream == "" && !p.Recoverable {
+			corrupt = true
+		}
+	}
+	if !corrupt {
+		t.Fatal(report.Problems)
+	}
+}
+
+func TestFrontendCompression(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 1000, MmapLogs: true, Codec: Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetCodec("gz/", Gzip); err != nil {
+		t.Fatal(err)
+	}
+	var all, allGz []byte
+	for i := 0; i < 30; i++ {
+		data := []byte(fmt.Sprintf("<%02d-%s>", i, strings.Repeat("abcdefgh", 30)))
+		all = append(all, data...)
+		if err := f.AppendRecord("s1", data, i%4 == 0); err != nil {
+			t.Fatal(err)
+		}
+		allGz = append(allGz, data...)
+		if err := f.Append("gz/s2", data, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Data which does not shrink is stored uncompressed
+	if err := f.Append("gz/s2", []byte("x"), true); err != nil {
+		t.Fatal(err)
+	}
+	allGz = append(allGz, 'x')
+	if len(f.logFiles) < 3 {
+		t.Fatal("Expected several logs", f.logFiles)
+	}
+	var size int64
+	for _, n := range f.logFiles {
+		info, err := os.Stat(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+	if size >= int64(len(all)+len(allGz)) {
+		t.Fatal("Data has not been compressed", size)
+	}
+
+	// Offsets refer to the uncompressed stream bytes
+	check := func(streamName string, want []byte, from int) {
+		t.Helper()
+		for offset := from; offset < len(want); offset += 97 {
+			buf := make([]byte, 300)
+			n, err := f.Read(streamName, uint64(offset), buf)
+			if err != nil && err != io.EOF {
+				t.Fatal(streamName, offset, err)
+			}
+			end := offset + 300
+			if end > len(want) {
+				end = len(want)
+			}
+			if string(buf[:n]) != string(want[offset:end]) {
+				t.Fatal(streamName, offset, string(buf[:n]))
+			}
+		}
+		var got []byte
+		if _, err := f.ReadDirect(streamName, uint64(from), len(want), func(data []byte) error {
+			got = append(got, data...)
+			return nil
+		}); err != nil || string(got) != string(want[from:]) {
+			t.Fatal(streamName, err, string(got))
+		}
+	}
+	check("s1", all, 0)
+	check("gz/s2", allGz, 0)
+
+	// Pollarding in the middle of a compressed append keeps the remaining bytes readable
+	pollard := len(all)/2 + 3
+	if err := f.Pollard("s1", uint64(pollard)); err != nil {
+		t.Fatal(err)
+	}
+	check("s1", all, pollard)
+	f.Close()
+
+	// Compression does not need to be configured for reading
+	f, err = NewFrontend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("s1", all, pollard)
+	check("gz/s2", allGz, 0)
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("s1", all, pollard)
+	check("gz/s2", allGz, 0)
+	f.Close()
+
+	report, err := Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatal(report.Problems)
+	}
+}
+
+// testCodec compresses like Deflate, but has its own ID.
+type testCodec struct {
+	id uint8
+}
+
+func (c testCodec) ID() uint8 {
+	return c.id
+}
+
+func (c testCodec) Compress(data []byte) ([]byte, error) {
+	return Deflate.Compress(data)
+}
+
+func (c testCodec) Decompress(dst []byte, src []byte) error {
+	return Deflate.Decompress(dst, src)
+}
+
+func TestFrontendCodecRegistration(t *testing.T) {
+	dir := t.TempDir()
+	// Codecs using the ID of another codec are rejected
+	if _, err := NewFrontendWithOptions(dir, Options{Codec: testCodec{id: Deflate.ID()}}); err != os.ErrExist {
+		t.Fatal(err)
+	}
+	f, err := NewFrontend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetCodec("t/", testCodec{id: Gzip.ID()}); err != os.ErrExist {
+		t.Fatal(err)
+	}
+	if err := f.SetCodec("t/", testCodec{id: 0}); err != os.ErrExist {
+		t.Fatal(err)
+	}
+	// Other codecs are registered, such that their payloads can be read
+	if err := f.SetCodec("t/", testCodec{id: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if !codecKnown(200) {
+		t.Fatal("The codec has not been registered")
+	}
+	data := []byte(strings.Repeat("abcdefgh", 30))
+	if err := f.Append("t/s1", data, true); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	f, err = NewFrontend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if n, err := f.Read("t/s1", 0, buf); err != nil || string(buf[:n]) != string(data) {
+		t.Fatal(n, err)
+	}
+	f.Close()
+
+	// Codecs of uncomparable types can be registered repeatedly
+	codec := tableCodec{testCodec: testCodec{id: 201}, table: []byte("abc")}
+	for i := 0; i < 2; i++ {
+		f, err = NewFrontendWithOptions(dir, Options{Codec: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.SetCodec("t/", codec); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	if err := RegisterCodec(testCodec{id: 201}); err != os.ErrExist {
+		t.Fatal(err)
+	}
+}
+
+// tableCodec is a codec whose type is not comparable.
+type tableCodec struct {
+	testCodec
+	table []byte
+}
+
+// testKeys is a KeyProvider with a key per ID. Streams starting with "plain" are not encrypted.
+type testKeys struct {
+	mutex   sync.Mutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func (k *testKeys) StreamKey(streamName string) (uint32, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if strings.HasPrefix(streamName, "plain") {
+		return 0, nil
+	}
+	return k.current, nil
+}
+
+func (k *testKeys) DictKey() (uint32, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.current, nil
+}
+
+func (k *testKeys) Key(id uint32) ([]byte, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// rotate makes a new key the current one.
+func (k *testKeys) rotate() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.current++
+	k.keys[k.current] = []byte(fmt.Sprintf("key-%011d-0123456789abcdef", k.current))
+}
+
+func TestFrontendEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keys := &testKeys{keys: make(map[uint32][]byte)}
+	keys.rotate()
+	f, err := NewFrontendWithOptions(dir, Options{MaxLogSize: 300, Keys: keys, Codec: Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []byte
+	appendAll := func(from int, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			data := []byte(fmt.Sprintf("<secret-%02d-abcdefghijklmnopqrstuvwxyz>", i))
+			all = append(all, data...)
+			if err := f.AppendRecord("s1", data, i%3 == 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Append("plain", []byte("public"), false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(from int) {
+		t.Helper()
+		buf := make([]byte, len(all))
+		if n, err := f.Read("s1", uint64(from), buf); (err != nil && err != io.EOF) || string(buf[:n]) != string(all[from:]) {
+			t.Fatal(n, err, string(buf[:n]))
+		}
+	}
+	appendAll(0, 20)
+	// Rotating the key does not affect existing data
+	keys.rotate()
+	appendAll(20, 40)
+	if err := f.Pollard("s1", 25); err != nil {
+		t.Fatal(err)
+	}
+	check(25)
+	if len(f.logFiles) < 3 {
+		t.Fatal("Expected several logs", f.logFiles)
+	}
+	for _, n := range f.logFiles {
+		content, err := os.ReadFile(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(content), "secret") {
+			t.Fatal("Plaintext in", n)
+		}
+	}
+	f.Close()
+
+	// The keys are required to read the store
+	f, err = NewFrontend(dir)
+	if err == nil {
+		buf := make([]byte, 10)
+		_, err = f.Read("s1", 25, buf)
+		f.Close()
+	}
+	if err == nil {
+		t.Fatal("Read encrypted data without keys")
+	}
+
+	f, err = NewFrontendWithOptions(dir, Options{MaxLogSize: 300, Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(25)
+	// Compaction re-encrypts the data with the current key
+	keys.rotate()
+	appendAll(40, 50)
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	keys.mutex.Lock()
+	delete(keys.keys, 1)
+	delete(keys.keys, 2)
+	keys.mutex.Unlock()
+	check(25)
+	f.Close()
+
+	report, err := CheckWithKeys(dir, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 || report.Unchecked != 0 {
+		t.Fatal(report.Problems, report.Unchecked)
+	}
+	// Without keys only the checksums of the encrypted dicts are verified
+	report, err = Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 || report.Unchecked == 0 || report.Unchecked != report.Logs {
+		t.Fatal(report.Problems, report.Unchecked, report.Logs)
+	}
+}
+
+func TestEncryptionBinding(t *testing.T) {
+	keys := &testKeys{keys: make(map[uint32][]byte)}
+	keys.rotate()
+	sealed, err := sealData(keys, 1, []byte("secret"), payloadAAD("s1", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := decodePayload(keys, 1, 0, sealed, 6, "s1", 10); err != nil || string(data) != "secret" {
+		t.Fatal(string(data), err)
+	}
+	// Data moved to another stream, offset or log does not decrypt
+	if _, err := decodePayload(keys, 1, 0, sealed, 6, "s2", 10); err == nil {
+		t.Fatal("Decrypted the payload of another stream")
+	}
+	if _, err := decodePayload(keys, 1, 0, sealed, 6, "s1", 11); err == nil {
+		t.Fatal("Decrypted the payload at another offset")
+	}
+	if _, err := openData(keys, 1, sealed, dictAAD(10)); err == nil {
+		t.Fatal("Decrypted a payload as dict")
+	}
+	sealed, err = sealData(keys, 1, []byte("dict"), dictAAD(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openData(keys, 1, sealed, dictAAD(4)); err == nil {
+		t.Fatal("Decrypted the dict of another log")
+	}
+	if data, err := openData(keys, 1, sealed, dictAAD(3)); err != nil || string(data) != "dict" {
+		t.Fatal(string(data), err)
+	}
+}
+
+func TestFrontendMemoryStorage(t *testing.T) {
+	storage := NewMemoryStorage()
+	const dir = "byos-memory-test"
+	options := Options{MaxLogSize: 100, Storage: storage, Codec: Gzip}
+	f, err := NewFrontendWithOptions(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []byte
+	for i := 0; i < 30; i++ {
+		data := []byte(fmt.Sprintf("<%02d-abcdefghijklmnopqrstuvwxyz>", i))
+		all = append(all, data...)
+		if err := f.AppendRecord("s1", data, i%3 == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Pollard("s1", 40); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Snapshot(filepath.Join(dir, "snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatal("The store has been written to disk", err)
+	}
+
+	for _, d := range []string{dir, filepath.Join(dir, "snapshot")} {
+		f, err = NewFrontendWithOptions(d, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(all))
+		if n, err := f.Read("s1", 40, buf); err != nil || string(buf[:n]) != string(all[40:]) {
+			t.Fatal(d, n, err, string(buf[:n]))
+		}
+		f.Close()
+		report, err := CheckStorage(storage, d, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 0 {
+			t.Fatal(d, report.Problems)
+		}
+	}
+}
+
+func TestFrontendAppendBatch(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{FlushInterval: time.Hour, Codec: Deflate}
+	f, err := NewFrontendWithOptions(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Append("s1", []byte("Hello"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AppendBatch(nil); err != nil {
+		t.Fatal(err)
+	}
+	f.syncer.mutex.Lock()
+	syncs := f.syncer.syncs
+	f.syncer.mutex.Unlock()
+	batch := []Append{
+		{StreamName: "s1", Data: []byte(" World")},
+		{StreamName: "s2", Data: []byte("abc"), Record: true},
+		{StreamName: "s1", Data: []byte("!"), Record: true},
+		{StreamName: "s2", Data: []byte("def")},
+	}
+	if err := f.AppendBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	// The batch and the append before it are made durable by one sync
+	f.syncer.mutex.Lock()
+	if f.syncer.syncs != syncs+1 {
+		t.Fatal("Syncs", f.syncer.syncs, syncs)
+	}
+	f.syncer.mutex.Unlock()
+	for _, name := range []string{"s1", "s2"} {
+		stat, err := f.Stat(name)
+		if err != nil || stat.DurableSize != stat.Size {
+			t.Fatal(name, stat, err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		var buf [12]byte
+		if n, err := f.Read("s1", 0, buf[:]); err != nil || n != 12 || string(buf[:]) != "Hello World!" {
+			t.Fatal(n, err, string(buf[:n]))
+		}
+		if n, err := f.Read("s2", 0, buf[:6]); err != nil || n != 6 || string(buf[:6]) != "abcdef" {
+			t.Fatal(n, err, string(buf[:n]))
+		}
+		if data, err := f.ReadRecord("s1", 0); err != nil || string(data) != "Hello World!" {
+			t.Fatal(err, string(data))
+		}
+		if data, err := f.ReadRecord("s2", 0); err != nil || string(data) != "abc" {
+			t.Fatal(err, string(data))
+		}
+		if _, err := f.ReadRecord("s2", 1); err != io.EOF {
+			t.Fatal(err)
+		}
+		// The batch is recovered after reopening the store
+		f.Close()
+		if f, err = NewFrontendWithOptions(dir, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+}
+
+func TestFrontendRecovery(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, storage Storage, dir string) {
+		options := Options{Storage: storage}
+		f, err := NewFrontendWithOptions(dir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := f.Recovery(); r.File != "" || r.Dropped != 0 || r.Reason != nil {
+			t.Fatal(r)
+		}
+		if err := f.Append("ps1", []byte("Hello World"), true); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		// Simulate a crash while an action is being written
+		fileName := filepath.Join(dir, "commit_0000.log")
+		data, err := readFile(storage, fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, fileName, append(data, byte(flagAppend), 1, 2)); err != nil {
+			t.Fatal(err)
+		}
+		f, err = NewFrontendWithOptions(dir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := f.Recovery(); r.File != fileName || r.Dropped != 3 || r.Reason == nil {
+			t.Fatal(r)
+		}
+		if stat, err := f.Stat("ps1"); err != nil || stat.Size != 11 {
+			t.Fatal(stat, err)
+		}
+		f.Close()
+
+		f, err = NewFrontendWithOptions(dir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := f.Recovery(); r.File != fileName || r.Dropped != 0 || r.Reason != nil {
+			t.Fatal(r)
+		}
+		f.Close()
+	})
+}
+
+func TestFrontendBaselineStore(t *testing.T) {
+	// The store has been written by the first version of byos
+	dir := t.TempDir()
+	data, err := os.ReadFile("testdata/baseline/commit_0000.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "commit_0000.log"), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		f, err := NewFrontend(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := f.Recovery(); r.Dropped != 0 || r.Reason != nil {
+			t.Fatal(r)
+		}
+		if stat, err := f.Stat("ps1"); err != nil || stat.Size != 12+uint64(i) {
+			t.Fatal(stat, err)
+		}
+		var buffer [16]byte
+		if n, err := f.Read("ps1", 6, buffer[:6]); err != nil || string(buffer[:n]) != "World!" {
+			t.Fatal(n, err, string(buffer[:n]))
+		}
+		if _, err := f.Read("ps1", 5, buffer[:]); err != errHeadUnavailable {
+			t.Fatal(err)
+		}
+		if n, err := f.Read("ps2", 0, buffer[:3]); err != nil || string(buffer[:n]) != "abc" {
+			t.Fatal(n, err, string(buffer[:n]))
+		}
+		if i == 0 {
+			// The outdated log is finalized and appends go to a new log
+			if err := f.Append("ps1", []byte("?"), true); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Append("ps2", []byte("def"), true); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			if n, err := f.Read("ps1", 12, buffer[:]); err != nil || string(buffer[:n]) != "?" {
+				t.Fatal(n, err, string(buffer[:n]))
+			}
+			if n, err := f.Read("ps2", 1, buffer[:]); err != nil || string(buffer[:n]) != "bcdef" {
+				t.Fatal(n, err, string(buffer[:n]))
+			}
+		}
+		f.Close()
+	}
+	report, err := Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatal(report.Problems)
+	}
 }
@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+// Logs of formatVersion2 start with a header.
+//
+//	magic     [4]byte  "byos"
+//	version   uint8
+//	flags     uint8
+//	reserved  [2]byte
+//	id        uint64   the number of the log file
+//	created   int64    creation time in nanoseconds since the Unix epoch
+//	first     uint64   the number of the oldest log file merged by a compaction, or id
+//	checksum  uint32   CRC32C over all bytes above
+const headerSize = 4 + 1 + 1 + 2 + 8 + 8 + 8 + checksumSize
+
+var headerMagic = [4]byte{'b', 'y', 'o', 's'}
+
+type headerFlags uint8
+
+const (
+	// The log has been written by a compaction
+	headerCompacted headerFlags = 1 << iota
+)
+
+type logHeader struct {
+	version uint8
+	flags   headerFlags
+	id      uint64
+	created time.Time
+	// A compacted log replaces the log files numbered first to id
+	first uint64
+}
+
+var errHeader = errors.New("Malformed log header")
+
+func (h *logHeader) marshal() []byte {
+	buf := make([]byte, headerSize)
+	copy(buf, headerMagic[:])
+	buf[4] = h.version
+	buf[5] = byte(h.flags)
+	binary.LittleEndian.PutUint64(buf[8:], h.id)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(h.created.UnixNano()))
+	binary.LittleEndian.PutUint64(buf[24:], h.first)
+	binary.LittleEndian.PutUint32(buf[32:], crc32.Checksum(buf[:32], crcTable))
+	return buf
+}
+
+func (h *logHeader) unmarshal(buf []byte) error {
+	if len(buf) < headerSize || !hasHeaderMagic(buf) {
+		return errHeader
+	}
+	if crc32.Checksum(buf[:32], crcTable) != binary.LittleEndian.Uint32(buf[32:]) {
+		return errChecksum
+	}
+	h.version = buf[4]
+	if h.version != formatVersion2 {
+		return errUnsupportedFormat
+	}
+	h.flags = headerFlags(buf[5])
+	h.id = binary.LittleEndian.Uint64(buf[8:])
+	h.created = time.Unix(0, int64(binary.LittleEndian.Uint64(buf[16:])))
+	h.first = binary.LittleEndian.Uint64(buf[24:])
+	return nil
+}
+
+// hasHeaderMagic returns true if the buffer starts with the magic of a log header.
+// The buffer can be shorter than the magic, e.g. if writing the header has been interrupted.
+func hasHeaderMagic(buf []byte) bool {
+	if len(buf) == 0 {
+		return false
+	}
+	for i := 0; i < len(buf) && i < len(headerMagic); i++ {
+		if buf[i] != headerMagic[i] {
+			return false
+		}
+	}
+	return true
+}
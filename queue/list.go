@@ -0,0 +1,109 @@
+package queue
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// A StreamIterator iterates over streams ordered by name.
+//
+//	it := f.List("bundle/")
+//	for it.Next() {
+//		fmt.Println(it.Name(), it.Stat().Size)
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type StreamIterator struct {
+	f *Frontend
+	// The names still to iterate over
+	names []string
+	name  string
+	stat  StreamStat
+	err   error
+}
+
+// List returns an iterator over all streams whose name starts with prefix, ordered by name.
+// The stream names are determined when List is called. Streams deleted while iterating are skipped.
+func (f *Frontend) List(prefix string) *StreamIterator {
+	it := &StreamIterator{f: f}
+	it.names, it.err = f.listNames(prefix)
+	return it
+}
+
+// listNames returns the sorted names of all streams starting with prefix that are known to any log.
+// Some of the streams might have been deleted.
+func (f *Frontend) listNames(prefix string) ([]string, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.log == nil {
+		return nil, os.ErrClosed
+	}
+	known := make(map[string]bool)
+	var names []string
+	add := func(streamName string) {
+		if !known[streamName] {
+			known[streamName] = true
+			names = append(names, streamName)
+		}
+	}
+	for streamName := range f.log.streams {
+		if strings.HasPrefix(streamName, prefix) {
+			add(streamName)
+		}
+	}
+	for _, r := range f.logReaders {
+		if ok, err := r.mayContainPrefix(prefix); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		if err := f.pool.acquire(r); err != nil {
+			return nil, err
+		}
+		r.walkPrefix(prefix, func(streamName string, e logReaderEntry) bool {
+			add(streamName)
+			return true
+		})
+		f.pool.release(r)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Next advances the iterator to the next stream.
+// It returns false when there are no more streams or an error occurred.
+func (it *StreamIterator) Next() bool {
+	for it.err == nil && len(it.names) > 0 {
+		streamName := it.names[0]
+		it.names = it.names[1:]
+		stat, err := it.f.Stat(streamName)
+		if err == os.ErrNotExist {
+			// The stream has been deleted
+			continue
+		} else if err != nil {
+			it.err = err
+			return false
+		}
+		it.name = streamName
+		it.stat = stat
+		return true
+	}
+	return false
+}
+
+// Name returns the name of the current stream.
+func (it *StreamIterator) Name() string {
+	return it.name
+}
+
+// Stat returns information about the current stream.
+func (it *StreamIterator) Stat() StreamStat {
+	return it.stat
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *StreamIterator) Err() error {
+	return it.err
+}
@@ -1,76 +1,460 @@
 package queue
 
 import (
+	"bytes"
+	"container/list"
 	"encoding/binary"
+	"hash/crc32"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/weistn/byos/queue/util"
 )
 
 type logReader struct {
+	storage  Storage
 	filename string
-	f        *os.File
+	f        File
 	dict     []byte
+	// The format version of the log
+	version uint8
+	// The header of the log. Its version is 0 for logs without header.
+	header logHeader
+	// The position of the first action in the log
+	start int64
+	// The position following the last action in the log
+	end int64
+	// The filter of the log, or nil if the format of the log has no filter.
+	// Once loaded, the filter is kept when the logReader is closed.
+	filter       *logFilter
+	filterLoaded bool
+	// If true, open tries to map the file into memory. Only files of the DiskStorage can be mapped.
+	mmap bool
+	// The mapped file, or nil if the file is not mapped
+	data []byte
+	// Protects opening and closing
+	mutex sync.Mutex
+	// Managed by the readerPool
+	elem *list.Element
+	// Number of times the logReader has been acquired from the readerPool and not released yet
+	pins int
+	// True if the logReader has been removed from the readerPool while being acquired.
+	// It is closed once it is released.
+	removed bool
+	// The modification time of the log file, or zero if it has not been determined yet
+	modTime time.Time
+	// Supplies the keys to decrypt the log, or nil
+	keys KeyProvider
+	// If true, open keeps an encrypted dict encrypted if there are no keys, instead of failing.
+	// Only the checksum of the dict is verified then. Used by Check.
+	keepSealed bool
 }
 
 type logReaderPiece struct {
 	pos    uint32
 	length uint32
+	// The stream offset of the first byte of the piece
+	offset uint64
+	// The number of bytes stored at pos. It differs from length if the piece is compressed or encrypted.
+	stored uint32
+	// The ID of the codec that compressed the piece, or 0 if the piece is not compressed
+	codec uint8
+	// The ID of the key that encrypted the piece, or 0 if the piece is not encrypted
+	key uint32
 }
 
+// Size of a piece in the dict: position, length and stream offset
+const pieceSize = 4 + 4 + 8
+
+// Size of a piece in the dict of formatVersion1, which does not store the offset of a piece
+const pieceSizeNoOffset = 4 + 4
+
+// Size of the storage of a piece in the dict: stored size, codec and key
+const pieceStorageSize = 4 + 1 + 4
+
 type logReaderEntry struct {
-	span   util.Span
-	pieces []logReaderPiece
+	// The name of the stream
+	name string
+	// Tells whether the stream has been deleted in the log
+	flags entryFlags
+	// The offset of the first stream byte that has not been pollarded
+	keep uint64
+	// The stream bytes stored in the log
+	span util.Span
+	// The pieces ordered by offset, serialized as in the dict of formatVersion2.
+	// This allows for a binary search without decoding all pieces.
+	pieces []byte
+	// The number of records that ended before the stream has been written to the log
+	records uint64
+	// The offsets following the last byte of all records ended in the log, serialized as in the dict.
+	ends []byte
+	// The commit times of the pieces, serialized as in the dict, or nil if the format of the log has no times.
+	times []byte
+	// The stored sizes, codecs and keys of the pieces, serialized as in the dict,
+	// or nil if the format of the log does not support compression.
+	storage []byte
 }
 
-func newLogReader(filename string) *logReader {
-	return &logReader{filename: filename}
+func newLogReader(storage Storage, filename string) *logReader {
+	return &logReader{storage: storage, filename: filename}
 }
 
-func (l *logReader) isOpen() bool {
-	return l.f != nil
+// ensureOpen opens the logReader unless it is already open.
+// It is safe for concurrent use.
+func (l *logReader) ensureOpen() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.f != nil {
+		return nil
+	}
+	return l.open()
 }
 
 func (l *logReader) open() error {
-	f, err := os.Open(l.filename)
+	f, err := l.storage.Open(l.filename)
 	if err != nil {
 		return err
 	}
-	// Read the trailer
-	if _, err := f.Seek(-16, os.SEEK_END); err != nil {
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
 		return err
 	}
-	var buf [16]byte
-	if _, err := f.Read(buf[:]); err != nil {
+	l.f = f
+	if osFile, ok := f.(*os.File); ok && l.mmap {
+		// If mapping fails, the logReader falls back to reading from the file
+		if data, err := mmapFile(osFile, info.Size()); err == nil {
+			l.data = data
+		}
+	}
+	var r io.ReaderAt = f
+	if l.data != nil {
+		r = bytes.NewReader(l.data)
+	}
+	if err := l.readVersion(r); err != nil {
+		l.closeFile()
+		return err
+	}
+	pos, size, err := l.readTrailer(r, info.Size())
+	if err != nil {
+		l.closeFile()
+		return err
+	}
+	if err := l.readDict(r, pos, size); err != nil {
+		l.closeFile()
+		return err
+	}
+	if err := l.openDict(); err != nil && (err != errKeyUnavailable || !l.keepSealed) {
+		l.closeFile()
+		return err
+	}
+	if !l.filterLoaded {
+		if err := l.readFilter(r, pos, size); err != nil {
+			l.closeFile()
+			return err
+		}
+	}
+	return nil
+}
+
+// finalizedTime returns the modification time of the log file.
+// No stream byte stored in the log has been appended after this time.
+// It is safe for concurrent use.
+func (l *logReader) finalizedTime() (time.Time, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.modTime.IsZero() {
+		info, err := l.storage.Stat(l.filename)
+		if err != nil {
+			return time.Time{}, err
+		}
+		l.modTime = info.ModTime()
+	}
+	return l.modTime, nil
+}
+
+// readAt reads from the mapped file or, if it is not mapped, from the file.
+func (l *logReader) readAt(p []byte, pos int64) (n int, err error) {
+	if l.data == nil {
+		return l.f.ReadAt(p, pos)
+	}
+	if pos < 0 || pos > int64(len(l.data)) {
+		return 0, os.ErrInvalid
+	}
+	n = copy(p, l.data[pos:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readVersion determines the format version from the header or the first action of the log.
+func (l *logReader) readVersion(r io.ReaderAt) error {
+	var buf [headerSize]byte
+	if _, err := r.ReadAt(buf[:], 0); err != nil {
 		return err
 	}
+	l.start = 0
+	if hasHeaderMagic(buf[:]) {
+		if err := l.header.unmarshal(buf[:]); err != nil {
+			return err
+		}
+		l.version = l.header.version
+		l.start = headerSize
+	} else {
+		// Logs without a header have the first format version
+		l.version = formatVersion1
+	}
+	return nil
+}
+
+// readTrailer checks the trailer of the finalized log. It returns the position and size
+// of the data between the last action and the trailer, i.e. the dict and the filter.
+func (l *logReader) readTrailer(r io.ReaderAt, fileSize int64) (pos int64, size int64, err error) {
+	var buf [16]byte
+	if fileSize < l.start+16 {
+		return 0, 0, os.ErrInvalid
+	}
+	if _, err := r.ReadAt(buf[:], fileSize-16); err != nil {
+		return 0, 0, err
+	}
 	// Check the trailer
 	if buf[8] != 42 || buf[9] != 0 || buf[10] != 42 || buf[11] != 0 {
-		return os.ErrInvalid
+		return 0, 0, os.ErrInvalid
 	}
 	if buf[12] != 42 || buf[13] != 0xff || buf[14] != 42 || buf[15] != 0xff {
-		return os.ErrInvalid
+		return 0, 0, os.ErrInvalid
+	}
+	size = int64(binary.LittleEndian.Uint64(buf[:]))
+	if size < 1+int64(checksumSizeOf(l.version)) || size > fileSize-16-l.start {
+		return 0, 0, os.ErrInvalid
+	}
+	return fileSize - 16 - size, size, nil
+}
+
+// filterSize returns the size of the filter, its checksum and its size stored behind the dict.
+func (l *logReader) filterSize(r io.ReaderAt, pos int64, size int64) (int64, error) {
+	if l.version == formatVersion1 {
+		return 0, nil
+	}
+	var buf [4]byte
+	if _, err := r.ReadAt(buf[:], pos+size-4); err != nil {
+		return 0, err
 	}
-	size := int64(binary.LittleEndian.Uint64(buf[:]))
-	// Read the dict.
-	if _, err = f.Seek(-size-16, os.SEEK_CUR); err != nil {
+	filterSize := int64(binary.LittleEndian.Uint32(buf[:])) + 4
+	if filterSize < 4+checksumSize || filterSize > size-1-checksumSize {
+		return 0, os.ErrInvalid
+	}
+	return filterSize, nil
+}
+
+// readDict reads the dict of the finalized log. If the log is mapped, the dict is not copied.
+func (l *logReader) readDict(r io.ReaderAt, pos int64, size int64) error {
+	filterSize, err := l.filterSize(r, pos, size)
+	if err != nil {
 		return err
 	}
-	l.dict = make([]byte, size)
-	if _, err := f.Read(l.dict[:]); err != nil {
-		l.dict = nil
+	l.end = pos
+	size -= filterSize
+	var dict []byte
+	if l.data != nil {
+		dict = l.data[pos : pos+size]
+	} else {
+		dict = make([]byte, size)
+		if _, err := r.ReadAt(dict, pos); err != nil {
+			return err
+		}
+	}
+	// Check the checksum of the dict
+	if checksumSizeOf(l.version) != 0 {
+		size -= checksumSize
+		if crc32.Checksum(dict[:size], crcTable) != binary.LittleEndian.Uint32(dict[size:]) {
+			return errChecksum
+		}
+	}
+	l.dict = dict[:size]
+	return nil
+}
+
+// openDict decrypts the dict if it is encrypted.
+func (l *logReader) openDict() error {
+	if l.version == formatVersion1 || len(l.dict) == 0 || l.dict[0] != flagSealedDict {
+		return nil
+	}
+	if len(l.dict) < 5 {
+		return errChecksum
+	}
+	dict, err := openData(l.keys, binary.LittleEndian.Uint32(l.dict[1:]), l.dict[5:], dictAAD(l.header.id))
+	if err != nil {
 		return err
 	}
-	l.f = f
+	l.dict = dict
 	return nil
 }
 
+// readFilter reads the filter of the finalized log. Logs of older formats have no filter.
+func (l *logReader) readFilter(r io.ReaderAt, pos int64, size int64) error {
+	filterSize, err := l.filterSize(r, pos, size)
+	if err != nil || filterSize == 0 {
+		l.filterLoaded = err == nil
+		return err
+	}
+	buf := make([]byte, filterSize-4)
+	if _, err := r.ReadAt(buf, pos+size-filterSize); err != nil {
+		return err
+	}
+	n := len(buf) - checksumSize
+	if crc32.Checksum(buf[:n], crcTable) != binary.LittleEndian.Uint32(buf[n:]) {
+		return errChecksum
+	}
+	filter := &logFilter{}
+	if err := filter.unmarshal(buf[:n]); err != nil {
+		return err
+	}
+	l.filter = filter
+	l.filterLoaded = true
+	return nil
+}
+
+// mayContain returns false if the log does not store the stream.
+// The filter is loaded on first use and kept in memory, even if the logReader is closed.
+// Hence most logs not storing the stream are skipped without opening them.
+// It is safe for concurrent use.
+func (l *logReader) mayContain(streamName string) (bool, error) {
+	filter, err := l.getFilter()
+	if err != nil || filter == nil {
+		// Logs of older formats have no filter
+		return err == nil, err
+	}
+	return filter.mayContain(streamName), nil
+}
+
+// mayContainPrefix returns false if the log does not store streams starting with the prefix.
+// It is safe for concurrent use.
+func (l *logReader) mayContainPrefix(prefix string) (bool, error) {
+	filter, err := l.getFilter()
+	if err != nil || filter == nil {
+		return err == nil, err
+	}
+	return filter.mayContainPrefix(prefix), nil
+}
+
+// getFilter returns the filter of the log, loading it if necessary,
+// or nil if the format of the log has no filter.
+func (l *logReader) getFilter() (*logFilter, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.filterLoaded {
+		if err := l.loadFilter(); err != nil {
+			return nil, err
+		}
+	}
+	return l.filter, nil
+}
+
+// loadFilter reads the filter without reading the dict.
+// The caller must hold the mutex.
+func (l *logReader) loadFilter() error {
+	if l.f != nil {
+		var r io.ReaderAt = l.f
+		if l.data != nil {
+			r = bytes.NewReader(l.data)
+		}
+		info, err := l.f.Stat()
+		if err != nil {
+			return err
+		}
+		pos, size, err := l.readTrailer(r, info.Size())
+		if err != nil {
+			return err
+		}
+		return l.readFilter(r, pos, size)
+	}
+	f, err := l.storage.Open(l.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := l.readVersion(f); err != nil {
+		return err
+	}
+	pos, size, err := l.readTrailer(f, info.Size())
+	if err != nil {
+		return err
+	}
+	return l.readFilter(f, pos, size)
+}
+
+// verify checks the checksums of all actions stored in the finalized log.
+// In case of an error, it returns the position of the first corrupted action.
+// The logReader must be open.
+func (l *logReader) verify() (pos int64, err error) {
+	// The actions are followed by the dict, its checksum, the filter and the trailer.
+	end := l.end
+	r := newSizedReader(io.NewSectionReader(l.f, l.start, end-l.start), end-l.start)
+	r.version = l.version
+	for pos = l.start; pos < end; {
+		flags, err := r.peekAction()
+		if err != nil {
+			return pos, err
+		}
+		r.resetChecksum()
+		switch flags & flagMask {
+		case flagAppend:
+			var a appendAction
+			err = a.read(r)
+		case flagPollard:
+			var a pollardAction
+			err = a.read(r)
+		case flagDelete:
+			var a deleteAction
+			err = a.read(r)
+		case flagBatch:
+			var a batchAction
+			err = a.read(r)
+		default:
+			err = errUnknownAction
+		}
+		if err == nil {
+			err = r.verifyChecksum()
+		}
+		if err != nil {
+			return pos, err
+		}
+		pos = end - r.left
+	}
+	return pos, nil
+}
+
 func (l *logReader) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	if l.f == nil {
 		return nil
 	}
-	err := l.f.Close()
+	return l.closeFile()
+}
+
+// closeFile unmaps and closes the file.
+func (l *logReader) closeFile() error {
+	var err error
+	if l.data != nil {
+		err = munmapFile(l.data)
+		l.data = nil
+	}
+	if err2 := l.f.Close(); err == nil {
+		err = err2
+	}
 	l.f = nil
+	l.dict = nil
 	return err
 }
 
@@ -80,33 +464,176 @@ func (l *logReader) read(e logReaderEntry, offset uint64, data []byte) (err erro
 	if offset < e.span.From || offset+uint64(len(data)) > e.span.To {
 		return os.ErrInvalid
 	}
-	piece := 0
-	eoffset := e.span.From
-	for ; offset >= eoffset+uint64(e.pieces[piece].length); piece++ {
-		eoffset += uint64(e.pieces[piece].length)
-	}
+	// Search the first piece that ends behind offset
+	piece := sort.Search(e.pieceCount(), func(i int) bool {
+		p := e.piece(i)
+		return p.offset+uint64(p.length) > offset
+	})
 	toRead := len(data)
 	done := 0
 	for ; toRead > 0; piece++ {
-		pos := e.pieces[piece].pos
-		posOffset := uint32(offset - eoffset)
-		readCount := int(e.pieces[piece].length - posOffset)
+		p := e.piece(piece)
+		posOffset := uint32(offset - p.offset)
+		readCount := int(p.length - posOffset)
 		if readCount > toRead {
 			readCount = toRead
 		}
-		n2, err := l.f.ReadAt(data[done:done+readCount], int64(pos+posOffset))
+		if p.encoded() {
+			// Compressed or encrypted pieces can only be decoded as a whole
+			raw, err := l.readEncoded(e, p)
+			if err != nil {
+				return err
+			}
+			copy(data[done:done+readCount], raw[posOffset:])
+			toRead -= readCount
+			done += readCount
+			offset += uint64(readCount)
+			continue
+		}
+		n2, err := l.readAt(data[done:done+readCount], int64(p.pos+posOffset))
 		if err != nil {
 			return err
 		}
 		toRead -= n2
 		done += n2
 		offset += uint64(readCount)
-		eoffset += uint64(e.pieces[piece].length)
 	}
 	return nil
 }
 
+// slices returns size stream bytes starting at offset.
+// If the log is mapped, the returned slices point into the mapping. They must not be modified
+// and are only valid until the logReader is closed. Compressed or encrypted pieces are decoded into new slices.
+// Otherwise the data is read into a single new slice.
+func (l *logReader) slices(e logReaderEntry, offset uint64, size int) ([][]byte, error) {
+	if l.data == nil {
+		data := make([]byte, size)
+		if err := l.read(e, offset, data); err != nil {
+			return nil, err
+		}
+		return [][]byte{data}, nil
+	}
+	if offset < e.span.From || offset+uint64(size) > e.span.To {
+		return nil, os.ErrInvalid
+	}
+	var result [][]byte
+	piece := sort.Search(e.pieceCount(), func(i int) bool {
+		p := e.piece(i)
+		return p.offset+uint64(p.length) > offset
+	})
+	for ; size > 0; piece++ {
+		p := e.piece(piece)
+		pos := int64(p.pos) + int64(offset-p.offset)
+		count := int(p.length) - int(offset-p.offset)
+		if count > size {
+			count = size
+		}
+		if p.encoded() {
+			// Compressed or encrypted pieces are decoded into a new slice
+			raw, err := l.readEncoded(e, p)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, raw[offset-p.offset:int(offset-p.offset)+count])
+			size -= count
+			offset += uint64(count)
+			continue
+		}
+		if pos+int64(count) > int64(len(l.data)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		result = append(result, l.data[pos:pos+int64(count)])
+		size -= count
+		offset += uint64(count)
+	}
+	return result, nil
+}
+
+// readEncoded reads, decrypts and decompresses a piece of the entry.
+func (l *logReader) readEncoded(e logReaderEntry, p logReaderPiece) ([]byte, error) {
+	stored := make([]byte, p.stored)
+	if _, err := l.readAt(stored, int64(p.pos)); err != nil {
+		return nil, err
+	}
+	return decodePayload(l.keys, p.key, p.codec, stored, int(p.length), e.name, p.offset)
+}
+
+// pieceCount returns the number of pieces storing the stream bytes.
+func (e *logReaderEntry) pieceCount() int {
+	return len(e.pieces) / pieceSize
+}
+
+// piece returns the i-th piece storing the stream bytes.
+func (e *logReaderEntry) piece(i int) logReaderPiece {
+	b := e.pieces[i*pieceSize:]
+	p := logReaderPiece{pos: binary.LittleEndian.Uint32(b), length: binary.LittleEndian.Uint32(b[4:]), offset: binary.LittleEndian.Uint64(b[8:])}
+	p.stored = p.length
+	if e.storage != nil {
+		b = e.storage[i*pieceStorageSize:]
+		p.stored = binary.LittleEndian.Uint32(b)
+		p.codec = b[4]
+		p.key = binary.LittleEndian.Uint32(b[5:])
+	}
+	return p
+}
+
+// encoded returns true if the piece is compressed or encrypted.
+func (p *logReaderPiece) encoded() bool {
+	return p.codec != 0 || p.key != 0
+}
+
+// pieceTime returns the commit time of the i-th piece in nanoseconds since the epoch.
+// The entry must have times.
+func (e *logReaderEntry) pieceTime(i int) int64 {
+	return int64(binary.LittleEndian.Uint64(e.times[i*8:]))
+}
+
+// expiry returns the offset of the first stream byte in the log that has been appended at or after t,
+// or the end of the span if all of them have been appended before.
+// expired is true if some stream bytes in the log have been appended before t.
+// The entry must have times.
+func (e *logReaderEntry) expiry(t time.Time) (offset uint64, expired bool) {
+	i := sort.Search(e.pieceCount(), func(i int) bool {
+		return e.pieceTime(i) >= t.UnixNano()
+	})
+	if i == e.pieceCount() {
+		return e.span.To, i > 0
+	}
+	return e.piece(i).offset, i > 0
+}
+
+// timeAt returns the commit time of the stream byte at offset and the offset following the piece holding it.
+// It returns false if the log does not store the byte or its commit time.
+func (e *logReaderEntry) timeAt(offset uint64) (t int64, end uint64, ok bool) {
+	if e.times == nil {
+		return 0, 0, false
+	}
+	i := sort.Search(e.pieceCount(), func(i int) bool {
+		p := e.piece(i)
+		return p.offset+uint64(p.length) > offset
+	})
+	if i == e.pieceCount() || e.piece(i).offset > offset {
+		return 0, 0, false
+	}
+	p := e.piece(i)
+	return e.pieceTime(i), p.offset + uint64(p.length), true
+}
+
+// recordCount returns the number of records ended in the log.
+func (e *logReaderEntry) recordCount() int {
+	return len(e.ends) / 8
+}
+
+// recordEnd returns the offset following the last byte of the i-th record ended in the log.
+func (e *logReaderEntry) recordEnd(i int) uint64 {
+	return binary.LittleEndian.Uint64(e.ends[i*8:])
+}
+
 func (l *logReader) search(streamName string) (logReaderEntry, error) {
+	if len(l.dict) <= 1 {
+		// The dict is empty
+		return logReaderEntry{}, os.ErrNotExist
+	}
 	// Search the matching position in the dict. Skip the flag byte
 	pos := 1
 	for {
@@ -124,8 +651,7 @@ func (l *logReader) search(streamName string) (logReaderEntry, error) {
 			if l.dict[pos+8+len(streamName)] != 0 {
 				pos = int(binary.LittleEndian.Uint32(l.dict[pos:]))
 			} else {
-				// A match has been found. Skip past the stream name.
-				pos += 8 + len(streamName) + 1
+				// A match has been found.
 				break
 			}
 		}
@@ -135,18 +661,104 @@ func (l *logReader) search(streamName string) (logReaderEntry, error) {
 		}
 	}
 
-	var e logReaderEntry
-	e.span.From = binary.LittleEndian.Uint64(l.dict[pos:])
-	e.span.To = binary.LittleEndian.Uint64(l.dict[pos+8:])
-	count := binary.LittleEndian.Uint16(l.dict[pos+16:])
-	pos += 8 + 8 + 2
+	_, e := l.entryAt(pos)
+	if e.flags&entryDeleted != 0 {
+		return e, errStreamDeleted
+	}
+	return e, nil
+}
 
-	e.pieces = make([]logReaderPiece, int(count))
-	for i := 0; i < int(count); i++ {
-		e.pieces[i].pos = binary.LittleEndian.Uint32(l.dict[pos:])
-		e.pieces[i].length = binary.LittleEndian.Uint32(l.dict[pos+4:])
-		pos += 4 + 4
+// entryAt parses the dict tree node at the given position.
+func (l *logReader) entryAt(pos int) (streamName string, e logReaderEntry) {
+	// Skip the positions of the left and right subtree
+	pos += 8
+	end := pos
+	for l.dict[end] != 0 {
+		end++
+	}
+	streamName = string(l.dict[pos:end])
+	e.name = streamName
+	pos = end + 1
+	if l.version != formatVersion1 {
+		e.flags = entryFlags(l.dict[pos])
+		pos++
 	}
 
-	return e, nil
+	var count uint32
+	if l.version == formatVersion1 {
+		// The first format stores the range of kept bytes and a 16 bit count only
+		e.span.From = binary.LittleEndian.Uint64(l.dict[pos:])
+		e.span.To = binary.LittleEndian.Uint64(l.dict[pos+8:])
+		e.keep = e.span.From
+		count = uint32(binary.LittleEndian.Uint16(l.dict[pos+16:]))
+		pos += 8 + 8 + 2
+	} else {
+		e.keep = binary.LittleEndian.Uint64(l.dict[pos:])
+		e.span.From = binary.LittleEndian.Uint64(l.dict[pos+8:])
+		e.span.To = binary.LittleEndian.Uint64(l.dict[pos+16:])
+		count = binary.LittleEndian.Uint32(l.dict[pos+24:])
+		pos += 8 + 8 + 8 + 4
+	}
+
+	if l.version == formatVersion1 {
+		// The first format stores neither the offsets of the pieces nor their times, storage and records.
+		// Compute the offsets.
+		e.pieces = make([]byte, int(count)*pieceSize)
+		offset := e.span.From
+		for i := 0; i < int(count); i++ {
+			b := e.pieces[i*pieceSize:]
+			copy(b[:8], l.dict[pos:pos+pieceSizeNoOffset])
+			binary.LittleEndian.PutUint64(b[8:], offset)
+			offset += uint64(binary.LittleEndian.Uint32(b[4:]))
+			pos += pieceSizeNoOffset
+		}
+		return streamName, e
+	}
+
+	e.pieces = l.dict[pos : pos+int(count)*pieceSize]
+	pos += int(count) * pieceSize
+	e.times = l.dict[pos : pos+e.pieceCount()*8]
+	pos += e.pieceCount() * 8
+	e.storage = l.dict[pos : pos+e.pieceCount()*pieceStorageSize]
+	pos += e.pieceCount() * pieceStorageSize
+	e.records = binary.LittleEndian.Uint64(l.dict[pos:])
+	count = binary.LittleEndian.Uint32(l.dict[pos+8:])
+	pos += 8 + 4
+	e.ends = l.dict[pos : pos+int(count)*8]
+	return streamName, e
+}
+
+// walk calls fn for all streams stored in the log, ordered by stream name.
+// Walking stops when fn returns false.
+func (l *logReader) walk(fn func(streamName string, e logReaderEntry) bool) {
+	l.walkPrefix("", fn)
+}
+
+// walkPrefix calls fn for all streams stored in the log whose name starts with prefix, ordered by stream name.
+// Subtrees of the dict which cannot hold such streams are skipped.
+// Walking stops when fn returns false.
+func (l *logReader) walkPrefix(prefix string, fn func(streamName string, e logReaderEntry) bool) {
+	if len(l.dict) <= 1 {
+		return
+	}
+	// The root of the tree follows the flag byte
+	l.walkSubtree(1, prefix, fn)
+}
+
+func (l *logReader) walkSubtree(pos int, prefix string, fn func(streamName string, e logReaderEntry) bool) bool {
+	streamName, e := l.entryAt(pos)
+	// The names in the left subtree are smaller and those in the right subtree are larger
+	if left := int(binary.LittleEndian.Uint32(l.dict[pos:])); left != 0 && streamName > prefix {
+		if !l.walkSubtree(left, prefix, fn) {
+			return false
+		}
+	}
+	matches := strings.HasPrefix(streamName, prefix)
+	if matches && !fn(streamName, e) {
+		return false
+	}
+	if right := int(binary.LittleEndian.Uint32(l.dict[pos+4:])); right != 0 && (matches || streamName < prefix) {
+		return l.walkSubtree(right, prefix, fn)
+	}
+	return true
 }
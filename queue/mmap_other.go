@@ -0,0 +1,19 @@
+//go:build !unix
+
+package queue
+
+import (
+	"errors"
+	"os"
+)
+
+var errMmapUnsupported = errors.New("Memory mapping is not supported")
+
+// mmapFile fails on this platform. Logs are read from the file instead.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return errMmapUnsupported
+}
@@ -0,0 +1,182 @@
+package queue
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// DefaultMaxOpenLogs is the number of finalized log files kept open, unless configured otherwise.
+const DefaultMaxOpenLogs = 256
+
+// DefaultMaxDictMemory is the total size of the dicts of open finalized log files, unless configured otherwise.
+const DefaultMaxDictMemory = 256 << 20
+
+// ReaderPoolStats contains statistics about the finalized log files kept open.
+type ReaderPoolStats struct {
+	// The number of open log files
+	Open int
+	// The total size of the dicts of the open log files
+	DictMemory int64
+	// The number of lookups that found the log file open
+	Hits uint64
+	// The number of lookups that had to open the log file
+	Misses uint64
+	// The number of log files closed to stay within the limits
+	Evictions uint64
+}
+
+// The readerPool limits the number of open logReaders and the memory used by their dicts.
+// The least recently used logReaders are closed when a limit is exceeded
+// and reopened transparently when they are needed again.
+// A logReader must be acquired before it is used and released afterwards.
+// Acquired logReaders are never closed by the pool.
+type readerPool struct {
+	maxOpen       int
+	maxDictMemory int64
+	// Protects all fields below and the pool fields of all logReaders
+	mutex sync.Mutex
+	// Open logReaders, the most recently used first
+	lru        list.List
+	dictMemory int64
+	hits       uint64
+	misses     uint64
+	evictions  uint64
+}
+
+func newReaderPool(maxOpen int, maxDictMemory int64) *readerPool {
+	return &readerPool{maxOpen: maxOpen, maxDictMemory: maxDictMemory}
+}
+
+// acquire opens the logReader unless it is open already and protects it from being closed until it is released.
+// Log files are opened while holding the pool mutex, hence opening them is serialized.
+func (p *readerPool) acquire(r *logReader) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if r.elem != nil {
+		p.hits++
+		p.lru.MoveToFront(r.elem)
+		r.pins++
+		return nil
+	}
+	p.misses++
+	if err := r.ensureOpen(); err != nil {
+		return err
+	}
+	r.elem = p.lru.PushFront(r)
+	r.pins++
+	p.dictMemory += int64(len(r.dict))
+	p.evict()
+	return nil
+}
+
+// pin protects an acquired logReader from being closed until release is called once more.
+func (p *readerPool) pin(r *logReader) {
+	p.mutex.Lock()
+	r.pins++
+	p.mutex.Unlock()
+}
+
+// release allows the pool to close the logReader again.
+// A logReader that has been removed meanwhile is closed.
+func (p *readerPool) release(r *logReader) {
+	p.mutex.Lock()
+	r.pins--
+	if r.pins == 0 && r.removed {
+		p.drop(r)
+	}
+	p.evict()
+	p.mutex.Unlock()
+}
+
+// evict closes the least recently used logReaders which are not acquired until the limits are met.
+// The caller must hold the mutex.
+func (p *readerPool) evict() {
+	for e := p.lru.Back(); e != nil && p.exceeded(); {
+		r := e.Value.(*logReader)
+		e = e.Prev()
+		if r.pins == 0 {
+			p.evictions++
+			p.drop(r)
+		}
+	}
+}
+
+// exceeded returns true if there are too many open logReaders or their dicts use too much memory.
+// The caller must hold the mutex.
+func (p *readerPool) exceeded() bool {
+	return (p.maxOpen > 0 && p.lru.Len() > p.maxOpen) || (p.maxDictMemory > 0 && p.dictMemory > p.maxDictMemory)
+}
+
+// drop closes the logReader and removes it from the pool.
+// The caller must hold the mutex.
+func (p *readerPool) drop(r *logReader) {
+	if r.elem != nil {
+		p.dictMemory -= int64(len(r.dict))
+		p.lru.Remove(r.elem)
+		r.elem = nil
+	}
+	r.close()
+}
+
+// remove closes the logReader and removes it from the pool, e.g. because its log file has been compacted.
+// If the logReader is acquired, it is closed once it is released.
+func (p *readerPool) remove(r *logReader) {
+	p.mutex.Lock()
+	p.dropUnlessAcquired(r)
+	p.mutex.Unlock()
+}
+
+// dropUnlessAcquired drops the logReader, or marks it to be dropped once it is released.
+// The caller must hold the mutex.
+func (p *readerPool) dropUnlessAcquired(r *logReader) {
+	if r.pins > 0 {
+		r.removed = true
+		return
+	}
+	p.drop(r)
+}
+
+// close closes all logReaders of the pool. Acquired logReaders are closed once they are released.
+func (p *readerPool) close() {
+	p.mutex.Lock()
+	for e := p.lru.Front(); e != nil; {
+		r := e.Value.(*logReader)
+		e = e.Next()
+		p.dropUnlessAcquired(r)
+	}
+	p.mutex.Unlock()
+}
+
+func (p *readerPool) stats() ReaderPoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return ReaderPoolStats{Open: p.lru.Len(), DictMemory: p.dictMemory, Hits: p.hits, Misses: p.misses, Evictions: p.evictions}
+}
+
+// search calls fn with the entry of the stream in a finalized log and returns nil,
+// or returns os.ErrNotExist if the log does not hold the stream.
+// If the stream has been deleted in the log, fn is called and errStreamDeleted is returned.
+// The entry must not be used after fn returns, since the logReader might be closed then.
+func (p *readerPool) search(r *logReader, streamName string, fn func(e logReaderEntry)) error {
+	if ok, err := r.mayContain(streamName); err != nil {
+		return err
+	} else if !ok {
+		return os.ErrNotExist
+	}
+	if err := p.acquire(r); err != nil {
+		return err
+	}
+	defer p.release(r)
+	e, err := r.search(streamName)
+	if err != nil && err != errStreamDeleted {
+		return err
+	}
+	fn(e)
+	return err
+}
+
+// ReaderPoolStats returns statistics about the finalized log files kept open.
+func (f *Frontend) ReaderPoolStats() ReaderPoolStats {
+	return f.pool.stats()
+}
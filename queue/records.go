@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"io"
+	"os"
+)
+
+// Streams can be divided into records. A record consists of all bytes
+// appended to the stream since the end of the previous record.
+// Records are numbered starting with 0. Pollarding records does not change
+// the numbers of the remaining records.
+
+// AppendRecord writes data to a stream and marks the end of a record.
+// The record consists of data and all data appended to the stream since the previous record ended.
+// If commit is true, AppendRecord returns once the record and all data written before has been synced to disk.
+func (f *Frontend) AppendRecord(streamName string, data []byte, commit bool) error {
+	return f.append(streamName, data, flagAppend|endOfRecord, commit)
+}
+
+// RecordCount returns the number of records that have been ended in the stream,
+// including those which have been pollarded.
+func (f *Frontend) RecordCount(streamName string) (uint64, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if _, _, err := f.streamState(streamName); err != nil {
+		return 0, err
+	}
+	return f.recordCount(streamName)
+}
+
+// ReadRecord returns the data of a record.
+// It returns io.EOF if the record has not been ended yet.
+func (f *Frontend) ReadRecord(streamName string, record uint64) ([]byte, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	start, end, err := f.recordSpan(streamName, record)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, end-start)
+	if _, err := f.read(streamName, start, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// PollardRecords drops all records before the given record from the stream.
+// Passing the number of records drops all records.
+func (f *Frontend) PollardRecords(streamName string, record uint64) error {
+	l := f.lockStream(streamName)
+	var offset uint64
+	var err error
+	if record > 0 {
+		f.mutex.RLock()
+		offset, err = f.recordEnd(streamName, record-1)
+		f.mutex.RUnlock()
+	}
+	var seq uint64
+	if err == nil {
+		seq, err = f.pollard(streamName, offset)
+	}
+	f.unlockStream(streamName, l)
+	if err != nil {
+		return err
+	}
+	return f.waitDurable(seq)
+}
+
+// recordCount returns the number of records that have been ended in the stream.
+// The most recent log that knows about the stream is authoritative.
+// The caller must hold the mutex, at least for reading.
+func (f *Frontend) recordCount(streamName string) (uint64, error) {
+	records, ends, err := f.log.streamRecords(streamName)
+	if err == nil {
+		return records + uint64(len(ends)), nil
+	} else if err == errStreamDeleted {
+		return 0, os.ErrNotExist
+	} else if err != os.ErrNotExist {
+		return 0, err
+	}
+	for logIndex := len(f.logReaders) - 1; logIndex >= 0; logIndex-- {
+		var count uint64
+		err = f.pool.search(f.logReaders[logIndex], streamName, func(e logReaderEntry) {
+			count = e.records + uint64(e.recordCount())
+		})
+		if err == nil {
+			return count, nil
+		} else if err == errStreamDeleted {
+			return 0, os.ErrNotExist
+		} else if err != os.ErrNotExist {
+			return 0, err
+		}
+	}
+	return 0, os.ErrNotExist
+}
+
+// recordSpan returns the offsets of the first byte of a record and of the byte following it.
+// The caller must hold the mutex, at least for reading.
+func (f *Frontend) recordSpan(streamName string, record uint64) (start uint64, end uint64, err error) {
+	if end, err = f.recordEnd(streamName, record); err != nil {
+		return 0, 0, err
+	}
+	if record > 0 {
+		if start, err = f.recordEnd(streamName, record-1); err != nil {
+			return 0, 0, err
+		}
+	}
+	return start, end, nil
+}
+
+// recordEnd returns the offset following the last byte of a record.
+// It returns errHeadUnavailable if the end of the record is no longer known, because it has been pollarded.
+// The caller must hold the mutex, at least for reading.
+func (f *Frontend) recordEnd(streamName string, record uint64) (uint64, error) {
+	if f.log == nil {
+		return 0, os.ErrClosed
+	}
+	// Search in the commit log first
+	found := false
+	records, ends, err := f.log.streamRecords(streamName)
+	if err == nil {
+		if record >= records+uint64(len(ends)) {
+			return 0, io.EOF
+		} else if record >= records {
+			return ends[record-records], nil
+		}
+		found = true
+	} else if err == errStreamDeleted {
+		return 0, os.ErrNotExist
+	} else if err != os.ErrNotExist {
+		return 0, err
+	}
+	// Search in all log readers, starting with the most recent one.
+	for logIndex := len(f.logReaders) - 1; logIndex >= 0; logIndex-- {
+		var records, count, end uint64
+		var flags entryFlags
+		err = f.pool.search(f.logReaders[logIndex], streamName, func(e logReaderEntry) {
+			records = e.records
+			count = uint64(e.recordCount())
+			flags = e.flags
+			if record >= records && record < records+count {
+				end = e.recordEnd(int(record - records))
+			}
+		})
+		if err == os.ErrNotExist {
+			continue
+		} else if err == errStreamDeleted && !found {
+			return 0, os.ErrNotExist
+		} else if err == errStreamDeleted {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if !found && record >= records+count {
+			return 0, io.EOF
+		} else if record >= records {
+			return end, nil
+		}
+		found = true
+		if flags&entryFresh != 0 {
+			// Older logs hold records of a deleted stream
+			break
+		}
+	}
+	if found {
+		return 0, errHeadUnavailable
+	}
+	return 0, os.ErrNotExist
+}
@@ -0,0 +1,301 @@
+package queue
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRetentionInterval is the interval at which retention policies are enforced
+// in the background, unless configured otherwise.
+const DefaultRetentionInterval = time.Minute
+
+// A RetentionPolicy tells which data is dropped from the beginning of streams automatically.
+// Data is dropped as soon as any of the limits is exceeded. The zero value keeps all data.
+// Streams consisting of records are only pollarded at the end of a record.
+type RetentionPolicy struct {
+	// Keeps at most this number of bytes at the end of a stream. A value of 0 disables the limit.
+	MaxBytes uint64
+	// Drops data which has been committed longer ago. A value of 0 disables the limit.
+	// Logs written by older versions do not tell when the bytes stored in them have been committed.
+	// Their bytes are dropped once the log file has been modified longer ago.
+	MaxAge time.Duration
+	// Drops data once it has been acknowledged.
+	Acknowledged bool
+}
+
+// The retainer enforces the retention policies in the background.
+type retainer struct {
+	f        *Frontend
+	interval time.Duration
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newRetainer(f *Frontend, interval time.Duration) *retainer {
+	r := &retainer{f: f, interval: interval, done: make(chan struct{})}
+	r.wg.Add(1)
+	go r.run()
+	return r
+}
+
+func (r *retainer) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			// Errors are not fatal. The next run will try again.
+			r.f.EnforceRetention()
+		}
+	}
+}
+
+// stop waits for a running enforcement to complete and terminates the retainer.
+func (r *retainer) stop() {
+	close(r.done)
+	r.wg.Wait()
+}
+
+// SetRetention applies a retention policy to all streams whose name starts with prefix.
+// A stream name is a prefix of itself, hence a policy can apply to a single stream, too.
+// If several prefixes match a stream, the policy of the longest prefix applies.
+// Setting the zero RetentionPolicy removes the policy of the prefix.
+// Policies are not persisted, i.e. they must be set whenever a Frontend is created.
+func (f *Frontend) SetRetention(prefix string, policy RetentionPolicy) {
+	f.retentionMutex.Lock()
+	defer f.retentionMutex.Unlock()
+	if policy == (RetentionPolicy{}) {
+		delete(f.retention, prefix)
+	} else {
+		f.retention[prefix] = policy
+	}
+}
+
+// Acknowledge tells that all stream bytes before offset have been consumed.
+// They are dropped by a RetentionPolicy with Acknowledged set.
+// Acknowledgements are not persisted. Acknowledged bytes which have not been dropped
+// when the Frontend is closed are kept until they are acknowledged again.
+func (f *Frontend) Acknowledge(streamName string, offset uint64) error {
+	f.mutex.RLock()
+	size, _, err := f.streamState(streamName)
+	f.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	if offset > size {
+		return os.ErrInvalid
+	}
+	f.retentionMutex.Lock()
+	if offset > f.acks[streamName] {
+		f.acks[streamName] = offset
+	}
+	f.retentionMutex.Unlock()
+	return nil
+}
+
+// EnforceRetention pollards all streams according to their retention policies.
+// It returns once the pollards are durable.
+// It is called in the background at Options.RetentionInterval.
+func (f *Frontend) EnforceRetention() error {
+	f.retentionMutex.Lock()
+	policies := make(map[string]RetentionPolicy, len(f.retention))
+	for prefix, policy := range f.retention {
+		policies[prefix] = policy
+	}
+	f.retentionMutex.Unlock()
+	now := time.Now()
+	var seq uint64
+	for prefix, policy := range policies {
+		names, err := f.listNames(prefix)
+		if err != nil {
+			return err
+		}
+		for _, streamName := range names {
+			if longestPrefix(policies, streamName) != prefix {
+				// Another policy applies
+				continue
+			}
+			s, err := f.retain(streamName, policy, now)
+			if err != nil {
+				return err
+			}
+			if s > seq {
+				seq = s
+			}
+		}
+	}
+	if seq == 0 {
+		return nil
+	}
+	return f.waitDurable(seq)
+}
+
+// longestPrefix returns the longest prefix of the stream name that has a policy.
+func longestPrefix(policies map[string]RetentionPolicy, streamName string) string {
+	result := ""
+	for prefix := range policies {
+		if strings.HasPrefix(streamName, prefix) && len(prefix) >= len(result) {
+			result = prefix
+		}
+	}
+	return result
+}
+
+// retain pollards the stream according to the policy and returns the sequence number of the pollardAction,
+// or 0 if no data has to be dropped.
+func (f *Frontend) retain(streamName string, policy RetentionPolicy, now time.Time) (seq uint64, err error) {
+	l := f.lockStream(streamName)
+	defer f.unlockStream(streamName, l)
+	f.mutex.RLock()
+	offset, keep, err := f.retainOffset(streamName, policy, now)
+	f.mutex.RUnlock()
+	if err == os.ErrNotExist {
+		// The stream has been deleted
+		return 0, nil
+	} else if err != nil || offset <= keep {
+		return 0, err
+	}
+	return f.pollard(streamName, offset)
+}
+
+// retainOffset returns the offset up to which the stream has to be pollarded according to the policy
+// and the offset of the first stream byte that has not been pollarded yet.
+// The caller must hold the mutex, at least for reading.
+func (f *Frontend) retainOffset(streamName string, policy RetentionPolicy, now time.Time) (offset uint64, keep uint64, err error) {
+	size, keep, err := f.streamState(streamName)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset = keep
+	if policy.MaxBytes > 0 && size > policy.MaxBytes && size-policy.MaxBytes > offset {
+		offset = size - policy.MaxBytes
+	}
+	if policy.MaxAge > 0 {
+		expired, err := f.offsetForTime(streamName, now.Add(-policy.MaxAge))
+		if err != nil {
+			return 0, 0, err
+		}
+		if expired > offset {
+			offset = expired
+		}
+	}
+	if policy.Acknowledged {
+		f.retentionMutex.Lock()
+		ack := f.acks[streamName]
+		f.retentionMutex.Unlock()
+		if ack > size {
+			// The stream has been deleted and recreated since
+			ack = 0
+		}
+		if ack > offset {
+			offset = ack
+		}
+	}
+	if offset <= keep {
+		return keep, keep, nil
+	}
+	count, err := f.recordCount(streamName)
+	if err != nil || count == 0 {
+		return offset, keep, err
+	}
+	offset, err = f.recordBoundary(streamName, count, keep, offset)
+	return offset, keep, err
+}
+
+// offsetForTime returns the offset of the first stream byte which might have been appended at or after t.
+// All stream bytes before have been appended before t. If no such bytes are known, it returns 0.
+// The caller must hold the mutex, at least for reading.
+func (f *Frontend) offsetForTime(streamName string, t time.Time) (uint64, error) {
+	// The offset of the first stream byte not known to be appended before t
+	var first uint64
+	// Search in the commit log first
+	offset, expired, err := f.log.streamExpiry(streamName, t)
+	if err == nil {
+		if expired {
+			return offset, nil
+		}
+		first = offset
+		if f.log.streamFresh(streamName) {
+			return first, nil
+		}
+	} else if err == errStreamDeleted {
+		return 0, os.ErrNotExist
+	} else if err != os.ErrNotExist {
+		return 0, err
+	}
+	// Search in all log readers, starting with the most recent one.
+	for logIndex := len(f.logReaders) - 1; logIndex >= 0; logIndex-- {
+		r := f.logReaders[logIndex]
+		var e logReaderEntry
+		err := f.pool.search(r, streamName, func(entry logReaderEntry) {
+			e = entry
+			if e.times != nil {
+				offset, expired = e.expiry(t)
+			}
+		})
+		if err == os.ErrNotExist {
+			continue
+		} else if err == errStreamDeleted {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if e.times != nil && expired {
+			return offset, nil
+		} else if e.times == nil {
+			// Logs of older formats do not tell when their bytes have been appended.
+			// None of them has been appended after the log file has been modified.
+			modTime, err := r.finalizedTime()
+			if err != nil {
+				return 0, err
+			}
+			if modTime.Before(t) {
+				// All bytes in this log and in older logs have been appended before t
+				if e.span.To > first {
+					first = e.span.To
+				}
+				return first, nil
+			}
+		}
+		first = e.span.From
+		if e.flags&entryFresh != 0 {
+			break
+		}
+	}
+	// No bytes appended before t have been found
+	return 0, nil
+}
+
+// recordBoundary returns the largest offset following a record which does not exceed offset,
+// or keep if there is none.
+// The caller must hold the mutex, at least for reading.
+func (f *Frontend) recordBoundary(streamName string, count uint64, keep uint64, offset uint64) (uint64, error) {
+	boundary := keep
+	// Binary search for the first record ending behind offset
+	lo, hi := uint64(0), count
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		end, err := f.recordEnd(streamName, mid)
+		if err == errHeadUnavailable {
+			// The record has been pollarded
+			lo = mid + 1
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		if end > offset {
+			hi = mid
+			continue
+		}
+		if end > boundary {
+			boundary = end
+		}
+		lo = mid + 1
+	}
+	return boundary, nil
+}
@@ -0,0 +1,106 @@
+package queue
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Snapshot writes a consistent copy of the store to the directory pathName, while appends continue.
+// The copy holds all data that has been written before Snapshot has been called.
+// Finalized log files are immutable, hence they are hard linked into the directory if possible and copied otherwise.
+// The commit log is copied up to the last action written before the call.
+// The directory is created if it does not exist. It must not contain log files.
+// To restore the snapshot, pass the directory (or a copy of it) to NewFrontend.
+func (f *Frontend) Snapshot(pathName string) error {
+	storage := f.options.Storage
+	if err := storage.MkdirAll(pathName); err != nil {
+		return err
+	}
+	names, err := storage.ReadDir(pathName)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if isLogFileName(n) {
+			return os.ErrExist
+		}
+	}
+	// Compactions remove finalized log files. Hold them off until the files have been copied
+	f.compactMutex.Lock()
+	defer f.compactMutex.Unlock()
+
+	// Determine the cut-off in the commit log
+	f.mutex.Lock()
+	if f.log == nil {
+		f.mutex.Unlock()
+		return os.ErrClosed
+	}
+	seq := f.written
+	size := int64(f.log.size)
+	files := append([]string{}, f.logFiles...)
+	f.mutex.Unlock()
+	// Everything up to the cut-off must be on disk before it can be copied.
+	// If the commit log is finalized in the meantime, the actions before the cut-off do not change.
+	if err := f.waitDurable(seq); err != nil {
+		return err
+	}
+
+	for _, n := range files[:len(files)-1] {
+		if err := linkOrCopyFile(storage, n, filepath.Join(pathName, filepath.Base(n))); err != nil {
+			return err
+		}
+	}
+	n := files[len(files)-1]
+	if err := copyFile(storage, n, filepath.Join(pathName, filepath.Base(n)), size); err != nil {
+		return err
+	}
+	return storage.SyncDir(pathName)
+}
+
+// linkOrCopyFile creates a hard link to a file or, if this is not possible, copies it.
+// The modification time is preserved, since retention relies on it for logs of older formats.
+func linkOrCopyFile(storage Storage, src string, dst string) error {
+	if err := storage.Link(src, dst); err == nil {
+		return nil
+	}
+	info, err := storage.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(storage, src, dst, info.Size()); err != nil {
+		return err
+	}
+	return storage.Chtimes(dst, info.ModTime())
+}
+
+// copyFile copies the first size bytes of a file and syncs the copy to disk.
+func copyFile(storage Storage, src string, dst string, size int64) error {
+	in, err := storage.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := storage.Stat(dst); err == nil {
+		return os.ErrExist
+	}
+	out, err := storage.Create(dst)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(io.NewOffsetWriter(out, 0), io.NewSectionReader(in, 0, size))
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		out.Close()
+		storage.Remove(dst)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		storage.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,367 @@
+package queue
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Storage holds the log files of a store. Files are named by paths, which are composed with filepath.Join.
+// A Storage must be safe for concurrent use.
+type Storage interface {
+	// Create creates or truncates a file and opens it for reading and writing.
+	Create(name string) (File, error)
+	// Open opens an existing file for reading.
+	Open(name string) (File, error)
+	// OpenWrite opens an existing file for reading and writing.
+	OpenWrite(name string) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	// Rename renames a file, replacing newName if it exists.
+	Rename(oldName string, newName string) error
+	// Link makes newName refer to the file oldName. It fails if newName exists.
+	Link(oldName string, newName string) error
+	// Chtimes sets the modification time of a file.
+	Chtimes(name string, modTime time.Time) error
+	// ReadDir returns the names of all files in a directory.
+	ReadDir(name string) ([]string, error)
+	// MkdirAll creates a directory and all of its parents.
+	MkdirAll(name string) error
+	// SyncDir persists changes to the entries of a directory.
+	SyncDir(name string) error
+}
+
+// A File is a file opened by a Storage.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	// Sync persists the content of the file.
+	Sync() error
+	Truncate(size int64) error
+}
+
+// DiskStorage stores files in the file system of the operating system.
+var DiskStorage Storage = diskStorage{}
+
+type diskStorage struct{}
+
+func (diskStorage) Create(name string) (File, error) {
+	return os.Create(name)
+}
+
+func (diskStorage) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (diskStorage) OpenWrite(name string) (File, error) {
+	return os.OpenFile(name, os.O_RDWR, 0755)
+}
+
+func (diskStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (diskStorage) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (diskStorage) Rename(oldName string, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (diskStorage) Link(oldName string, newName string) error {
+	return os.Link(oldName, newName)
+}
+
+func (diskStorage) Chtimes(name string, modTime time.Time) error {
+	return os.Chtimes(name, modTime, modTime)
+}
+
+func (diskStorage) ReadDir(name string) ([]string, error) {
+	dir, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(0)
+	dir.Close()
+	return names, err
+}
+
+func (diskStorage) MkdirAll(name string) error {
+	return os.MkdirAll(name, 0755)
+}
+
+func (diskStorage) SyncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	dir.Close()
+	return err
+}
+
+// memoryStorage keeps files in memory. Directories exist implicitly.
+type memoryStorage struct {
+	mutex sync.Mutex
+	files map[string]*memoryData
+}
+
+// memoryData is the content of a file. Files linked to each other share it.
+type memoryData struct {
+	mutex   sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+type memoryFile struct {
+	name     string
+	d        *memoryData
+	writable bool
+	closed   bool
+}
+
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// NewMemoryStorage returns a Storage that keeps all files in memory. Its content is lost when it is no longer used.
+// Directories need not be created. Every directory exists and holds the files whose names it prefixes.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{files: make(map[string]*memoryData)}
+}
+
+func (s *memoryStorage) Create(name string) (File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name = filepath.Clean(name)
+	d, ok := s.files[name]
+	if !ok {
+		d = &memoryData{}
+		s.files[name] = d
+	}
+	d.mutex.Lock()
+	d.data = nil
+	d.modTime = time.Now()
+	d.mutex.Unlock()
+	return &memoryFile{name: name, d: d, writable: true}, nil
+}
+
+func (s *memoryStorage) Open(name string) (File, error) {
+	return s.open("open", name, false)
+}
+
+func (s *memoryStorage) OpenWrite(name string) (File, error) {
+	return s.open("open", name, true)
+}
+
+func (s *memoryStorage) open(op string, name string, writable bool) (*memoryFile, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	d, ok := s.files[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return &memoryFile{name: name, d: d, writable: writable}, nil
+}
+
+func (s *memoryStorage) Stat(name string) (os.FileInfo, error) {
+	f, err := s.open("stat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return f.Stat()
+}
+
+func (s *memoryStorage) Remove(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := s.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(s.files, name)
+	return nil
+}
+
+func (s *memoryStorage) Rename(oldName string, newName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	oldName = filepath.Clean(oldName)
+	d, ok := s.files[oldName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	delete(s.files, oldName)
+	s.files[filepath.Clean(newName)] = d
+	return nil
+}
+
+func (s *memoryStorage) Link(oldName string, newName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	d, ok := s.files[filepath.Clean(oldName)]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	newName = filepath.Clean(newName)
+	if _, ok := s.files[newName]; ok {
+		return &os.LinkError{Op: "link", Old: oldName, New: newName, Err: os.ErrExist}
+	}
+	s.files[newName] = d
+	return nil
+}
+
+func (s *memoryStorage) Chtimes(name string, modTime time.Time) error {
+	f, err := s.open("chtimes", name, false)
+	if err != nil {
+		return err
+	}
+	f.d.mutex.Lock()
+	f.d.modTime = modTime
+	f.d.mutex.Unlock()
+	return nil
+}
+
+func (s *memoryStorage) ReadDir(name string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name = filepath.Clean(name)
+	var names []string
+	for n := range s.files {
+		if filepath.Dir(n) == name {
+			names = append(names, filepath.Base(n))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *memoryStorage) MkdirAll(name string) error {
+	return nil
+}
+
+func (s *memoryStorage) SyncDir(name string) error {
+	return nil
+}
+
+func (f *memoryFile) Name() string {
+	return f.name
+}
+
+func (f *memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	f.d.mutex.RLock()
+	defer f.d.mutex.RUnlock()
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.writable {
+		return 0, os.ErrPermission
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.d.mutex.Lock()
+	defer f.d.mutex.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.d.data)) {
+		data := make([]byte, end, end+end/4)
+		copy(data, f.d.data)
+		f.d.data = data
+	}
+	f.d.modTime = time.Now()
+	return copy(f.d.data[off:], p), nil
+}
+
+func (f *memoryFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memoryFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	f.d.mutex.RLock()
+	defer f.d.mutex.RUnlock()
+	return &memoryFileInfo{name: filepath.Base(f.name), size: int64(len(f.d.data)), modTime: f.d.modTime}, nil
+}
+
+func (f *memoryFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if !f.writable {
+		return os.ErrPermission
+	}
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	f.d.mutex.Lock()
+	defer f.d.mutex.Unlock()
+	if size <= int64(len(f.d.data)) {
+		f.d.data = f.d.data[:size]
+	} else {
+		f.d.data = append(f.d.data, make([]byte, size-int64(len(f.d.data)))...)
+	}
+	f.d.modTime = time.Now()
+	return nil
+}
+
+func (i *memoryFileInfo) Name() string {
+	return i.name
+}
+
+func (i *memoryFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *memoryFileInfo) Mode() os.FileMode {
+	return 0644
+}
+
+func (i *memoryFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *memoryFileInfo) IsDir() bool {
+	return false
+}
+
+func (i *memoryFileInfo) Sys() interface{} {
+	return nil
+}
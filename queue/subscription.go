@@ -0,0 +1,216 @@
+package queue
+
+import (
+	"os"
+	"sort"
+	"sync"
+)
+
+// A Subscription follows the tail of a stream.
+// It is notified whenever data appended to the stream has become durable.
+type Subscription struct {
+	f          *Frontend
+	streamName string
+	// Notify receives a value when durable data beyond Offset is available.
+	// Notifications are coalesced, i.e. one notification can announce the data of several appends.
+	// The channel is closed when the subscription is canceled or the Frontend is closed.
+	Notify <-chan struct{}
+	notify chan struct{}
+	// Protects offset
+	mutex sync.Mutex
+	// The offset of the next stream byte delivered by Read
+	offset uint64
+	// True once notify has been closed. Protected by the subscriptionsMutex of the Frontend.
+	closed bool
+}
+
+// notification tells that an append to a stream has been written with the given sequence number.
+type notification struct {
+	seq        uint64
+	streamName string
+}
+
+// Subscribe returns a subscription that delivers the stream data starting at fromOffset.
+// The stream does not need to exist yet.
+func (f *Frontend) Subscribe(streamName string, fromOffset uint64) (*Subscription, error) {
+	notify := make(chan struct{}, 1)
+	s := &Subscription{f: f, streamName: streamName, Notify: notify, notify: notify, offset: fromOffset}
+	f.subscriptionsMutex.Lock()
+	if f.subscriptions == nil {
+		f.subscriptionsMutex.Unlock()
+		return nil, os.ErrClosed
+	}
+	f.subscriptions[streamName] = append(f.subscriptions[streamName], s)
+	f.subscriptionsMutex.Unlock()
+	// Some data might be available already
+	stat, err := f.Stat(streamName)
+	if err == nil && stat.DurableSize > fromOffset {
+		s.signal()
+	} else if err != nil && err != os.ErrNotExist {
+		s.Cancel()
+		return nil, err
+	}
+	// Appends written before subscribing did not queue a notification
+	if err == nil && stat.Size > stat.DurableSize {
+		f.notifyPending(streamName)
+	}
+	return s, nil
+}
+
+// Offset returns the offset of the next stream byte delivered by Read.
+func (s *Subscription) Offset() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.offset
+}
+
+// Read reads durable stream data starting at Offset and advances Offset.
+// It returns 0 and no error if no new data is available.
+func (s *Subscription) Read(data []byte) (n int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stat, err := s.f.Stat(s.streamName)
+	if err == os.ErrNotExist {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if stat.DurableSize <= s.offset {
+		return 0, nil
+	}
+	if uint64(len(data)) > stat.DurableSize-s.offset {
+		data = data[:int(stat.DurableSize-s.offset)]
+	}
+	count, err := s.f.Read(s.streamName, s.offset, data)
+	if err != nil {
+		return 0, err
+	}
+	s.offset += count
+	if s.offset < stat.DurableSize {
+		// Tell that there is more data
+		s.signal()
+	}
+	return int(count), nil
+}
+
+// Cancel terminates the subscription and closes its Notify channel.
+func (s *Subscription) Cancel() {
+	f := s.f
+	f.subscriptionsMutex.Lock()
+	defer f.subscriptionsMutex.Unlock()
+	subs := f.subscriptions[s.streamName]
+	for i, sub := range subs {
+		if sub == s {
+			subs = append(subs[:i:i], subs[i+1:]...)
+			if len(subs) == 0 {
+				delete(f.subscriptions, s.streamName)
+			} else {
+				f.subscriptions[s.streamName] = subs
+			}
+			s.closed = true
+			close(s.notify)
+			return
+		}
+	}
+}
+
+// signal notifies the subscription, unless it has been canceled.
+func (s *Subscription) signal() {
+	s.f.subscriptionsMutex.Lock()
+	s.post()
+	s.f.subscriptionsMutex.Unlock()
+}
+
+// post sends a notification unless one is pending already or the subscription has been canceled.
+// The caller must hold the subscriptionsMutex.
+func (s *Subscription) post() {
+	if s.closed {
+		return
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// hasSubscriptions returns true if the stream has subscriptions.
+// The caller must hold the subscriptionsMutex.
+func (f *Frontend) hasSubscriptions(streamName string) bool {
+	return len(f.subscriptions[streamName]) != 0
+}
+
+// queueNotification remembers to notify the subscriptions of the stream
+// once the append with the given sequence number has become durable.
+func (f *Frontend) queueNotification(streamName string, seq uint64) {
+	f.subscriptionsMutex.Lock()
+	if f.hasSubscriptions(streamName) {
+		f.notifications = append(f.notifications, notification{seq: seq, streamName: streamName})
+	}
+	f.subscriptionsMutex.Unlock()
+}
+
+// notifyPending remembers to notify the subscriptions of the stream once the appends
+// to the stream that are pending now have become durable.
+func (f *Frontend) notifyPending(streamName string) {
+	f.mutex.RLock()
+	var seq uint64
+	if p := f.pending[streamName]; len(p) > 0 {
+		seq = p[len(p)-1].seq
+	}
+	f.mutex.RUnlock()
+	if seq == 0 {
+		return
+	}
+	f.subscriptionsMutex.Lock()
+	defer f.subscriptionsMutex.Unlock()
+	// The syncer advances the durable sequence number before it notifies the subscriptions.
+	// Hence either it finds the notification or the append is durable already.
+	if seq <= f.syncer.durableSeq() {
+		for _, s := range f.subscriptions[streamName] {
+			s.post()
+		}
+		return
+	}
+	// Notifications are ordered by sequence number
+	i := sort.Search(len(f.notifications), func(i int) bool { return f.notifications[i].seq > seq })
+	f.notifications = append(f.notifications, notification{})
+	copy(f.notifications[i+1:], f.notifications[i:])
+	f.notifications[i] = notification{seq: seq, streamName: streamName}
+}
+
+// notifyStream notifies the subscriptions of the stream.
+func (f *Frontend) notifyStream(streamName string) {
+	f.subscriptionsMutex.Lock()
+	for _, s := range f.subscriptions[streamName] {
+		s.post()
+	}
+	f.subscriptionsMutex.Unlock()
+}
+
+// notifySubscriptions notifies the subscriptions of all streams whose appends
+// up to the given sequence number have become durable.
+func (f *Frontend) notifySubscriptions(durable uint64) {
+	f.subscriptionsMutex.Lock()
+	defer f.subscriptionsMutex.Unlock()
+	i := 0
+	for ; i < len(f.notifications) && f.notifications[i].seq <= durable; i++ {
+		for _, s := range f.subscriptions[f.notifications[i].streamName] {
+			s.post()
+		}
+	}
+	f.notifications = f.notifications[:copy(f.notifications, f.notifications[i:])]
+}
+
+// closeSubscriptions closes the Notify channel of all subscriptions.
+func (f *Frontend) closeSubscriptions() {
+	f.subscriptionsMutex.Lock()
+	defer f.subscriptionsMutex.Unlock()
+	for _, subs := range f.subscriptions {
+		for _, s := range subs {
+			s.closed = true
+			close(s.notify)
+		}
+	}
+	f.subscriptions = nil
+	f.notifications = nil
+}
@@ -0,0 +1,179 @@
+package queue
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// The syncer makes buffered actions durable.
+// Actions that do not need to be committed immediately are flushed and synced
+// periodically or when too many bytes are buffered.
+// With group commit, appenders write their actions to the buffered commit log and wait until
+// the syncer has flushed and synced the log. Concurrent appenders arriving
+// within the latency window share one write and one fsync.
+type syncer struct {
+	f *Frontend
+	// The group commit latency window, or 0 if group commit is disabled.
+	window        time.Duration
+	flushInterval time.Duration
+	// Protects the fields below
+	mutex sync.Mutex
+	cond  *sync.Cond
+	// Actions are numbered in the order they are written to the commit log.
+	// All actions up to durable have been synced to disk.
+	durable uint64
+	// The first error that occurred while syncing
+	err error
+	// True when the syncer has been stopped
+	stopped bool
+	// Number of syncs carried out by the syncer
+	syncs int
+	// Held while the commit log file is synced without holding the frontend mutex.
+	// The frontend must hold it while finalizing or closing the commit log.
+	fileMutex sync.Mutex
+	kick      chan struct{}
+	done      chan struct{}
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+func newSyncer(f *Frontend, window time.Duration, flushInterval time.Duration) *syncer {
+	s := &syncer{f: f, window: window, flushInterval: flushInterval, kick: make(chan struct{}, 1), done: make(chan struct{})}
+	s.cond = sync.NewCond(&s.mutex)
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+func (s *syncer) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.sync()
+			continue
+		case <-s.kick:
+		}
+		if s.window > 0 {
+			// Wait for more appenders to join the group
+			timer := time.NewTimer(s.window)
+			select {
+			case <-s.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		s.sync()
+	}
+}
+
+// trigger asks the syncer to sync without waiting for the result.
+func (s *syncer) trigger() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// durableSeq returns the sequence number of the latest action that has been synced to disk.
+func (s *syncer) durableSeq() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.durable
+}
+
+// sync flushes and syncs all actions written to the commit log so far.
+func (s *syncer) sync() {
+	f := s.f
+	f.mutex.Lock()
+	if f.log == nil || f.log.finalized {
+		// Finalizing synced the log already
+		f.mutex.Unlock()
+		return
+	}
+	seq := f.written
+	if seq <= s.durableSeq() {
+		// Nothing to do
+		f.mutex.Unlock()
+		return
+	}
+	err := f.log.w.Flush()
+	f.log.synced = f.log.size
+	s.fileMutex.Lock()
+	file := f.log.w.f
+	// Appenders can continue writing to the buffer while the file is synced
+	f.mutex.Unlock()
+	if err == nil {
+		err = file.Sync()
+	}
+	s.fileMutex.Unlock()
+	s.mutex.Lock()
+	s.syncs++
+	s.mutex.Unlock()
+	s.markDurable(seq, err)
+	if err == nil {
+		f.mutex.Lock()
+		f.pruneDurable()
+		f.mutex.Unlock()
+	}
+}
+
+// markDurable releases all appenders waiting for actions up to seq
+// and notifies the subscriptions of the streams written by these actions.
+func (s *syncer) markDurable(seq uint64, err error) {
+	s.mutex.Lock()
+	advanced := false
+	if err != nil {
+		if s.err == nil {
+			s.err = err
+		}
+	} else if seq > s.durable {
+		s.durable = seq
+		advanced = true
+	}
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+	if advanced {
+		s.f.notifySubscriptions(seq)
+	}
+}
+
+// waitDurable blocks until the action with the given sequence number has been synced to disk.
+func (s *syncer) waitDurable(seq uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.durable < seq {
+		if s.err != nil {
+			return s.err
+		}
+		if s.stopped {
+			return os.ErrClosed
+		}
+		s.trigger()
+		s.cond.Wait()
+	}
+	return nil
+}
+
+// stop terminates the syncer. Appenders still waiting are released by the
+// final sync that happens when the commit log is closed.
+// Stopping a stopped syncer has no effect.
+func (s *syncer) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+	s.wg.Wait()
+}
+
+// close marks the syncer as stopped. All waiting appenders are released.
+func (s *syncer) close(seq uint64, err error) {
+	s.markDurable(seq, err)
+	s.mutex.Lock()
+	s.stopped = true
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+}